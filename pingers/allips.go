@@ -0,0 +1,107 @@
+package pingers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const ipTag = "ip"
+
+// ipMetricPrefix prefixes the name of the metrics reported for each address of a target
+const ipMetricPrefix = "ip_"
+
+// pingAllIPs probes concurrently each address of the target host, the metrics of each probe are
+// prefixed by ip_ and labeled with the address. The target is up if all of its addresses are.
+func pingAllIPs(target *Target, reporter MetricReporter) error {
+	rule := target.Rule
+	host, labels, err := targetHost(target)
+	if err != nil {
+		log.Printf("cannot get the host of %s, %v\n", target.Addr, err)
+		reporter.ReportSuccess(false, rule.MetricName, labels)
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(rule.Timeout))
+	ips, err := rule.resolveIPs(ctx, host)
+	cancel()
+	if err != nil {
+		log.Printf("Couldn't resolve %s: %v\n", host, err)
+		reporter.ReportValue(0, "ips_total", labels)
+		reporter.ReportValue(0, "ips_healthy", labels)
+		reporter.ReportSuccess(false, rule.MetricName, labels)
+		return err
+	}
+
+	reporters := make([]*labeledReporter, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		ipRule := *rule
+		ipRule.targetHost = host
+		ipRule.targetIP = ip
+		reporters[i] = newLabeledReporter(reporter, ipMetricPrefix, ipTag, ip.String(), rule.MetricName)
+		wg.Add(1)
+		go func(ipReporter *labeledReporter) {
+			defer wg.Done()
+			ping(target.Addr, ipReporter, &ipRule)
+		}(reporters[i])
+	}
+	wg.Wait()
+	target.forgetStaleIPs(ips, reporter, labels)
+
+	healthy := 0
+	for _, ipReporter := range reporters {
+		if ipReporter.healthy {
+			healthy++
+		}
+	}
+	reporter.ReportValue(float64(len(ips)), "ips_total", labels)
+	reporter.ReportValue(float64(healthy), "ips_healthy", labels)
+	reporter.ReportSuccess(healthy == len(ips), rule.MetricName, labels)
+	if healthy != len(ips) {
+		return fmt.Errorf("%d of %d addresses of %s are unhealthy", len(ips)-healthy, len(ips), target.Addr)
+	}
+	return nil
+}
+
+// targetHost returns the host to resolve for the target and the labels of its metrics
+func targetHost(target *Target) (string, map[string]string, error) {
+	tags := target.Rule.tags
+	switch target.Rule.Type {
+	case "http":
+		URL, err := url.Parse(target.Addr)
+		if err != nil {
+			return "", pingerLabels(target.Addr, "", tags), err
+		}
+		return URL.Hostname(), urlLabels(URL, tags), nil
+	case "tcp", "udp":
+		host, _, err := net.SplitHostPort(target.Addr)
+		return host, addrLabel(target.Addr, tags), err
+	}
+	return target.Addr, hostLabel(target.Addr, tags), nil
+}
+
+// forgetStaleIPs records the addresses probed for the target. The series and the state kept between probes,
+// like persistent transports, of the addresses probed before but not resolved anymore are deleted, otherwise
+// they would be exported forever with their last values.
+func (t *Target) forgetStaleIPs(ips []net.IP, reporter MetricReporter, labels map[string]string) {
+	probed := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		probed[ip.String()] = true
+	}
+	t.ipsMu.Lock()
+	defer t.ipsMu.Unlock()
+	for ip := range t.ips {
+		if probed[ip] {
+			continue
+		}
+		reporter.DeleteSeries(withLabel(labels, ipTag, ip))
+		if t.Rule.Type == "http" {
+			t.Rule.HTTPRule.forgetTarget(ipTargetKey(t.Addr, ip))
+		}
+	}
+	t.ips = probed
+}
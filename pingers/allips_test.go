@@ -0,0 +1,74 @@
+package pingers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// the series and the transport of an address are deleted when it is not resolved anymore
+func TestPingAllIPsForgetsStaleIPs(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	server.Listener.Close()
+	server.Listener = ln
+	server.Start()
+	defer server.Close()
+
+	resolved := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}
+	defer func(lookup func(context.Context, string, string) ([]net.IP, error)) { lookupIP = lookup }(lookupIP)
+	lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		return resolved, nil
+	}
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	addr := "http://backends.test:" + port + "/"
+	rule := &Rule{Type: "http", ProbeAllIPs: true, HTTPRule: &HTTPRule{ReuseConnections: true}}
+	if err := rule.setup(); err != nil {
+		t.Fatal(err)
+	}
+	target := &Target{Name: "backends", Addr: addr, Rule: rule}
+	reporter := NewReporter("", nil)
+	u, _ := url.Parse(addr)
+	labels := urlLabels(u, nil)
+	ipSeries := func(ip string) int {
+		n := 0
+		for key := range collect(t, reporter) {
+			if strings.HasPrefix(key, ipMetricPrefix) && strings.Contains(key, "\xff"+ipTag+"="+ip+"\xff") {
+				n++
+			}
+		}
+		return n
+	}
+
+	if err := Ping(target, reporter); err != nil {
+		t.Fatal(err)
+	}
+	if ipSeries("127.0.0.1") == 0 || ipSeries("127.0.0.2") == 0 || len(rule.HTTPRule.transports) != 2 {
+		t.Fatalf("got %v and %d transports, expected the series and transports of both addresses",
+			collect(t, reporter), len(rule.HTTPRule.transports))
+	}
+
+	resolved = resolved[:1]
+	if err := Ping(target, reporter); err != nil {
+		t.Fatal(err)
+	}
+	values := collect(t, reporter)
+	if ipSeries("127.0.0.2") != 0 {
+		t.Errorf("got %v, expected the series of 127.0.0.2 to be deleted", values)
+	}
+	if ipSeries("127.0.0.1") == 0 || values[ipMetricPrefix+DefaultMetricName+labelsKey(withLabel(labels, ipTag, "127.0.0.1"))] != 1 ||
+		values["ips_total"+labelsKey(labels)] != 1 || values[DefaultMetricName+labelsKey(labels)] != 1 {
+		t.Errorf("got %v, expected the series of 127.0.0.1 and one address in total", values)
+	}
+	if _, ok := rule.HTTPRule.transports[ipTargetKey(addr, "127.0.0.2")]; ok || len(rule.HTTPRule.transports) != 1 {
+		t.Errorf("got %d transports, expected the transport of 127.0.0.2 to be dropped", len(rule.HTTPRule.transports))
+	}
+}
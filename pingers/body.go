@@ -0,0 +1,134 @@
+package pingers
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// streamedBody is the result of reading a response body while evaluating the body assertions of a rule
+type streamedBody struct {
+	body         []byte // only kept if needed after reading
+	size         int
+	truncated    bool // true if the body is larger than read_max
+	contentOK    bool // body_content and body_regexp
+	mustMatch    []bool
+	mustNotMatch []bool
+}
+
+// readBody reads up to ReadMax bytes of r, evaluating the body assertions of the rule as the body is read.
+// The body is kept in memory only if keep is true.
+func readBody(r io.Reader, httpRule *HTTPRule, keep bool) (*streamedBody, error) {
+	regexes := []*regexp.Regexp{}
+	if httpRule.CompiledRegex != nil {
+		regexes = append(regexes, httpRule.CompiledRegex)
+	}
+	regexes = append(regexes, httpRule.CompiledMustMatch...)
+	regexes = append(regexes, httpRule.CompiledMustNotMatch...)
+
+	writers := []io.Writer{}
+	pipes := make([]*io.PipeWriter, len(regexes))
+	matched := make([]bool, len(regexes))
+	var wg sync.WaitGroup
+	for i, re := range regexes {
+		pr, pw := io.Pipe()
+		pipes[i] = pw
+		writers = append(writers, pw)
+		wg.Add(1)
+		go func(i int, re *regexp.Regexp) {
+			defer wg.Done()
+			matched[i] = re.MatchReader(bufio.NewReader(pr))
+			// drain the pipe so that writing the body does not block
+			io.Copy(ioutil.Discard, pr)
+		}(i, re)
+	}
+	var content *contentMatcher
+	if len(httpRule.BodyContentBytes) > 0 {
+		content = &contentMatcher{expected: httpRule.BodyContentBytes}
+		writers = append(writers, content)
+	}
+	var buffer bytes.Buffer
+	if keep {
+		writers = append(writers, &buffer)
+	}
+
+	size, err := io.Copy(io.MultiWriter(writers...), io.LimitReader(r, httpRule.ReadMax))
+	truncated := false
+	if err == nil && size == httpRule.ReadMax {
+		n, _ := io.ReadFull(r, make([]byte, 1))
+		truncated = n > 0
+	}
+	for _, pw := range pipes {
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	streamed := &streamedBody{
+		size:      int(size),
+		truncated: truncated,
+		contentOK: true,
+	}
+	if keep {
+		streamed.body = buffer.Bytes()
+	}
+	if httpRule.CompiledRegex != nil {
+		streamed.contentOK = matched[0]
+		matched = matched[1:]
+	} else if content != nil {
+		streamed.contentOK = content.match()
+	}
+	streamed.mustMatch = matched[:len(httpRule.CompiledMustMatch)]
+	streamed.mustNotMatch = matched[len(httpRule.CompiledMustMatch):]
+	return streamed, nil
+}
+
+// contentMatcher checks that what is written to it is the expected content, ignoring leading and trailing spaces.
+// Spaces are Unicode white space, like for bytes.TrimSpace, so the runes around the content are decoded.
+type contentMatcher struct {
+	expected []byte
+	pos      int
+	started  bool
+	failed   bool
+	pending  []byte // bytes of the rune being decoded before or after the content
+}
+
+func (m *contentMatcher) Write(b []byte) (int, error) {
+	for _, c := range b {
+		if m.failed {
+			break
+		}
+		if m.started && m.pos < len(m.expected) {
+			m.failed = c != m.expected[m.pos]
+			m.pos++
+			continue
+		}
+		m.pending = append(m.pending, c)
+		if !utf8.FullRune(m.pending) {
+			continue
+		}
+		r, _ := utf8.DecodeRune(m.pending)
+		runeBytes := m.pending
+		m.pending = nil
+		switch {
+		case r != utf8.RuneError && unicode.IsSpace(r):
+		case m.started:
+			m.failed = true
+		default:
+			m.started = true
+			m.Write(runeBytes)
+		}
+	}
+	return len(b), nil
+}
+
+func (m *contentMatcher) match() bool {
+	return !m.failed && m.pos == len(m.expected) && len(m.pending) == 0
+}
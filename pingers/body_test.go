@@ -0,0 +1,43 @@
+package pingers
+
+import (
+	"bytes"
+	"testing"
+)
+
+// the matcher must agree with the comparison of the trimmed body, whatever the size of the writes
+func TestContentMatcher(t *testing.T) {
+	expected := []byte("OK ✓")
+	bodies := []string{
+		"OK ✓",
+		"  \t\nOK ✓\r\n",
+		"\u00a0\u2003OK ✓\u3000\u2028",
+		"\u0085OK ✓ ",
+		"\xa0OK ✓",
+		"OK ✓\x85",
+		"OK ✓\xe2\x80",
+		"OK ✓ x",
+		"OK",
+		"OK ✓✓",
+		"OK \xe2\x9c",
+		"\u200bOK ✓", // zero width space is not white space
+		"",
+		" ",
+	}
+	for _, body := range bodies {
+		want := bytes.Equal(bytes.TrimSpace([]byte(body)), expected)
+		for size := 1; size <= len(body)+1; size++ {
+			m := &contentMatcher{expected: expected}
+			for i := 0; i < len(body); i += size {
+				end := i + size
+				if end > len(body) {
+					end = len(body)
+				}
+				m.Write([]byte(body[i:end]))
+			}
+			if got := m.match(); got != want {
+				t.Errorf("body %q written by %d bytes: got %t, expected %t", body, size, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package pingers
+
+import (
+	"log"
+)
+
+// checkFailedMetricName is the metric telling, for each assertion made on a probe, if it failed
+const checkFailedMetricName = "check_failed"
+
+// check is the result of one assertion made on a probe
+type check struct {
+	name string
+	ok   bool
+}
+
+// reportChecks reports a check_failed metric labeled with the name of each check, and logs failed checks.
+// It returns true if all the checks passed.
+func reportChecks(checks []check, addr string, reporter MetricReporter, labels map[string]string) bool {
+	ok := true
+	for _, c := range checks {
+		failed := 0.0
+		if !c.ok {
+			log.Printf("check %s failed for %s", c.name, addr)
+			failed = 1
+			ok = false
+		}
+		reporter.ReportValue(failed, checkFailedMetricName, withLabel(labels, checkTag, c.name))
+	}
+	return ok
+}
@@ -0,0 +1,91 @@
+package pingers
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// errUnsupportedEncoding is returned for content encodings the prober can request but not decode, like br
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += n
+	return n, err
+}
+
+// contentEncoding returns the normalized Content-Encoding of a response, identity if none
+func contentEncoding(header string) string {
+	encoding := strings.ToLower(strings.TrimSpace(header))
+	if encoding == "" {
+		return "identity"
+	}
+	return encoding
+}
+
+// decodeBody returns a reader decoding body according to its content encoding
+func decodeBody(body io.Reader, encoding string) (io.Reader, error) {
+	switch encoding {
+	case "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(body)
+		if err == io.EOF {
+			// empty body
+			return body, nil
+		}
+		return reader, err
+	case "deflate":
+		// deflate is supposed to be zlib wrapped, but some servers send raw deflate
+		buffered := bufio.NewReader(body)
+		header, err := buffered.Peek(2)
+		if err == nil && (int(header[0])<<8|int(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	case "br":
+		return nil, errUnsupportedEncoding
+	}
+	return nil, fmt.Errorf("unknown content encoding %s", encoding)
+}
+
+// acceptsEncoding returns true if the Accept-Encoding header value requests encoding with a non zero quality
+func acceptsEncoding(header string, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), encoding) {
+			continue
+		}
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				if quality, err := strconv.ParseFloat(q[2:], 64); err == nil && quality == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func validContentEncoding(encoding string, httpRule *HTTPRule) bool {
+	for _, valid := range httpRule.ValidContentEncodings {
+		if strings.ToLower(valid) == encoding {
+			return true
+		}
+	}
+	return false
+}
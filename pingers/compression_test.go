@@ -0,0 +1,85 @@
+package pingers
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBody(t *testing.T) {
+	const content = "hello, hello, hello world"
+	compress := func(newWriter func(w io.Writer) io.WriteCloser) string {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		io.WriteString(w, content)
+		w.Close()
+		return buf.String()
+	}
+	gzipped := compress(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+	zlibbed := compress(func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) })
+	deflated := compress(func(w io.Writer) io.WriteCloser {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	})
+	tests := []struct {
+		name     string
+		body     string
+		encoding string
+		want     string
+		err      bool
+	}{
+		{"identity", content, contentEncoding(""), content, false},
+		{"gzip", gzipped, contentEncoding(" GZip "), content, false},
+		{"x-gzip", gzipped, "x-gzip", content, false},
+		{"empty gzip", "", "gzip", "", false},
+		{"invalid gzip", "not gzip", "gzip", "", true},
+		{"zlib deflate", zlibbed, "deflate", content, false},
+		{"raw deflate", deflated, "deflate", content, false},
+		{"br", "", "br", "", true},
+		{"unknown", content, "compress", "", true},
+	}
+	for _, test := range tests {
+		reader, err := decodeBody(strings.NewReader(test.body), test.encoding)
+		var decoded []byte
+		if err == nil {
+			decoded, err = ioutil.ReadAll(reader)
+		}
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: got %q, expected an error", test.name, decoded)
+			}
+			continue
+		}
+		if err != nil || string(decoded) != test.want {
+			t.Errorf("%s: got %q, %v, expected %q", test.name, decoded, err, test.want)
+		}
+	}
+	if _, err := decodeBody(strings.NewReader(""), "br"); err != errUnsupportedEncoding {
+		t.Errorf("got %v for br, expected %v", err, errUnsupportedEncoding)
+	}
+}
+
+func TestAcceptBrotli(t *testing.T) {
+	tests := []struct {
+		name     string
+		httpRule *HTTPRule
+		ok       bool
+	}{
+		{"br without body checks", &HTTPRule{AcceptEncoding: "gzip, br"}, true},
+		{"br with a body regex", &HTTPRule{AcceptEncoding: "gzip, br", BodyRegex: "ok"}, false},
+		{"br with a json assertion", &HTTPRule{AcceptEncoding: "BR;q=0.5", JSONAssertions: []*JSONAssertion{{JQQuery: ".status"}}}, false},
+		{"refused br with a body regex", &HTTPRule{AcceptEncoding: "gzip, br;q=0", BodyRegex: "ok"}, true},
+		{"gzip with a body regex", &HTTPRule{AcceptEncoding: "gzip, deflate", BodyRegex: "ok"}, true},
+	}
+	for _, test := range tests {
+		err := test.httpRule.setup()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, expected success %t", test.name, err, test.ok)
+		}
+	}
+}
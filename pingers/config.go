@@ -2,7 +2,17 @@ package pingers
 
 import (
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 // DefaultTimeout is the default timeout if not specified
@@ -14,6 +24,27 @@ const DefaultMetricName = "Up"
 // DefaultReadMax is the default max size of body to read
 const DefaultReadMax = 1e+7
 
+// DefaultAcceptEncoding is the default Accept-Encoding header of HTTP probes
+const DefaultAcceptEncoding = "gzip"
+
+// DefaultMaxRedirects is the default max number of redirects followed by HTTP probes
+const DefaultMaxRedirects = 10
+
+// DefaultMaxLinks is the default maximum number of links checked on an HTML page
+const DefaultMaxLinks = 50
+
+// DefaultLinkConcurrency is the default number of links of an HTML page fetched at the same time
+const DefaultLinkConcurrency = 5
+
+var captureNameRegex = regexp.MustCompile(`^\w+$`)
+
+// varRegex matches the uses of variables in transaction steps
+var varRegex = regexp.MustCompile(`\$\{(\w+)\}`)
+
+var validHTTPVersionRegex = regexp.MustCompile(`^HTTP/[0-9]\.[0-9]$`)
+
+var sha256Regex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
 // Configuration contains the rules and targets for these rules.
 // This is the data structure parsed from YAML
 type Configuration struct {
@@ -26,35 +57,273 @@ type Configuration struct {
 // Rule is a definition of asserts to do on a ping.
 type Rule struct {
 	tags       map[string]string
-	Type       string    `yaml:"type"`                  // tcp, http, icmp or mysql
+	Type       string    `yaml:"type"`                  // tcp, udp, http, transaction, websocket, sse, grpc, icmp or mysql
 	Timeout    int       `yaml:"timeout,omitempty"`     // timeout in seconds
 	MetricName string    `yaml:"metric_name,omitempty"` // metric name used for health report, default value is Up
-	HTTPRule   *HTTPRule `yaml:"http,omitempty"`        // is required for type http
+	HTTPRule   *HTTPRule `yaml:"http,omitempty"`        // is required for type http, its request and response settings are also used by websocket and sse
+	TCPRule    *TCPRule  `yaml:"tcp,omitempty"`         // is required for type tcp
+
+	TransactionRule *TransactionRule `yaml:"transaction,omitempty"` // is required for type transaction
+	WebSocketRule   *WebSocketRule   `yaml:"websocket,omitempty"`   // is required for type websocket
+	SSERule         *SSERule         `yaml:"sse,omitempty"`         // is required for type sse
+	GRPCRule        *GRPCRule        `yaml:"grpc,omitempty"`        // is required for type grpc
+	UDPRule         *UDPRule         `yaml:"udp,omitempty"`         // is required for type udp
+
+	PreferredIPProtocol string `yaml:"preferred_ip_protocol,omitempty"` // ip4 or ip6, if set targets are resolved and reached with this IP protocol only
+	IPProtocolFallback  bool   `yaml:"ip_protocol_fallback,omitempty"`  // if set, use the other IP protocol when the target has no address of the preferred one
+	ProbeAllIPs         bool   `yaml:"probe_all_ips,omitempty"`         // if set, every address of the target host is probed, for http, tcp, udp and icmp rules
+
+	ProxyProtocol       string `yaml:"proxy_protocol,omitempty"`        // v1 or v2, if set a PROXY protocol header is sent once connected
+	ProxyProtocolSource string `yaml:"proxy_protocol_source,omitempty"` // source IP, with an optional port, of the PROXY protocol header, default is the local address
+
+	Expect string `yaml:"expect,omitempty"` // for tcp and udp rules, open (default), or closed, refused or filtered to assert the port is not reachable
+
+	MaxLatency      float64 `yaml:"max_latency,omitempty"`      // in seconds, if set a probe taking longer fails
+	DegradedLatency float64 `yaml:"degraded_latency,omitempty"` // in seconds, if set a successful probe taking longer is degraded in the status metric
+
+	proxyProtocolSource *net.TCPAddr
+
+	targetHost string // host of the target, always reached at targetIP when set
+	targetIP   net.IP
+
+	mysqlNet         string    // network name of the dial function registered for mysql targets
+	mysqlIPProtocols *sync.Map // IP protocol used by the last connection to each mysql address
+}
+
+// TCPRule contains the configuration of tcp checks
+type TCPRule struct {
+	ProxyURL       string           `yaml:"proxy_url,omitempty"` // if set, connect through this HTTP CONNECT (http or https) or socks5 proxy, socks5h to let the proxy resolve the target
+	ParsedProxyURL *url.URL         `yaml:"-"`
+	TLS            bool             `yaml:"tls,omitempty"`            // if set, a TLS handshake is made once connected
+	Insecure       bool             `yaml:"insecure,omitempty"`       // if set, the TLS certificate is not checked
+	QueryResponse  []*QueryResponse `yaml:"query_response,omitempty"` // steps run in order once connected
+}
+
+// QueryResponse is a step of the script of a tcp rule. It waits for a line matching Expect, then sends Send
+// followed by CRLF. ${name} in Send is replaced by the group of a previous Expect with this name or index.
+// A StartTLS step runs a TLS handshake on the connection.
+type QueryResponse struct {
+	Expect         string         `yaml:"expect,omitempty"`
+	CompiledExpect *regexp.Regexp `yaml:"-"`
+	Send           string         `yaml:"send,omitempty"`
+	StartTLS       bool           `yaml:"starttls,omitempty"`
 }
 
 // HTTPRule contains the configuration for the list of http checks to do
 type HTTPRule struct {
-	IgnoreHTTPStatus   bool            `yaml:"ignore_http_status,omitempty"` // ignore HTTP status for health report
-	ValidHTTPStatuses  []int           `yaml:"statuses,omitempty"`
-	BodyContentBytes   []byte          `yaml:"-"`
-	BodyContent        string          `yaml:"body_content,omitempty"` // if set, the HTTP response body must be BodyContent
-	BodyRegex          string          `yaml:"body_regexp,omitempty"`  // if set, the HTTP response body must match BodyRegex
-	CompiledRegex      *regexp.Regexp  `yaml:"-"`
-	PayloadExtractRule *PayloadExtract `yaml:"payload_extract,omitempty"`
-	Insecure           bool            `yaml:"insecure,omitempty"`
-	ReadMax            int64           `yaml:"read_max,omitempty"`
+	IgnoreHTTPStatus      bool               `yaml:"ignore_http_status,omitempty"` // ignore HTTP status for health report
+	ValidHTTPStatuses     []int              `yaml:"statuses,omitempty"`
+	BodyContentBytes      []byte             `yaml:"-"`
+	BodyContent           string             `yaml:"body_content,omitempty"` // if set, the HTTP response body must be BodyContent
+	BodyRegex             string             `yaml:"body_regexp,omitempty"`  // if set, the HTTP response body must match BodyRegex
+	CompiledRegex         *regexp.Regexp     `yaml:"-"`
+	BodyMustMatch         []string           `yaml:"body_must_match,omitempty"` // the HTTP response body must match each of these regexes
+	CompiledMustMatch     []*regexp.Regexp   `yaml:"-"`
+	BodyMustNotMatch      []string           `yaml:"body_must_not_match,omitempty"` // the HTTP response body must not match any of these regexes
+	CompiledMustNotMatch  []*regexp.Regexp   `yaml:"-"`
+	PayloadExtractRule    *PayloadExtract    `yaml:"payload_extract,omitempty"`
+	PayloadExtractRules   []*PayloadExtract  `yaml:"payload_extracts,omitempty"`
+	JSONAssertions        []*JSONAssertion   `yaml:"json_assertions,omitempty"` // all must hold on the JSON response body
+	Insecure              bool               `yaml:"insecure,omitempty"`
+	ReadMax               int64              `yaml:"read_max,omitempty"`
+	FailOnTruncation      bool               `yaml:"fail_on_truncation,omitempty"`  // if set, a body larger than read_max fails the probe instead of being truncated
+	NoFollowRedirects     bool               `yaml:"no_follow_redirects,omitempty"` // if set, redirects are not followed and the 3xx response is checked
+	MaxRedirects          int                `yaml:"max_redirects,omitempty"`       // max number of redirects to follow, default value is 10, the redirects metric does not count the refused one
+	FinalURLRegex         string             `yaml:"final_url_regexp,omitempty"`    // if set, the URL of the last response must match FinalURLRegex
+	CompiledFinalURL      *regexp.Regexp     `yaml:"-"`
+	LocationRegex         string             `yaml:"location_regexp,omitempty"` // if set, the Location header of the last response must match LocationRegex
+	CompiledLocation      *regexp.Regexp     `yaml:"-"`
+	HeadersMatch          []*HeaderMatch     `yaml:"headers_match,omitempty"`     // each header must be present and match its regex
+	HeadersNotMatch       []*HeaderMatch     `yaml:"headers_not_match,omitempty"` // each header, if present, must not match its regex
+	ProxyURL              string             `yaml:"proxy_url,omitempty"`         // if set, send requests through this http, https, socks5 or socks5h proxy
+	ParsedProxyURL        *url.URL           `yaml:"-"`
+	NoProxy               []string           `yaml:"no_proxy,omitempty"`                // hosts, domains, IPs or CIDRs, with an optional port, not to reach through the proxy
+	HTTPVersion           string             `yaml:"http_version,omitempty"`            // 1.1 to force HTTP/1.1, 2 to require HTTP/2, default is HTTP/1.1
+	ValidHTTPVersions     []string           `yaml:"valid_http_versions,omitempty"`     // if set, the response protocol must be one of these, like HTTP/1.1 or HTTP/2.0
+	ReuseConnections      bool               `yaml:"reuse_connections,omitempty"`       // if set, connections are kept alive between probes of a target
+	AcceptEncoding        string             `yaml:"accept_encoding,omitempty"`         // Accept-Encoding header of the request, default value is gzip, br cannot be requested with body checks
+	ValidContentEncodings []string           `yaml:"valid_content_encodings,omitempty"` // if set, the Content-Encoding of the response must be one of these, identity if none
+	ContentHash           bool               `yaml:"content_hash,omitempty"`            // if set, the SHA-256 of the body is exported with the time it last changed
+	ContentHashRegex      string             `yaml:"content_hash_regexp,omitempty"`     // if set, only the matches of this regex (their first group if any) are hashed
+	CompiledContentHash   *regexp.Regexp     `yaml:"-"`
+	ExpectedContentHash   string             `yaml:"expected_content_hash,omitempty"` // if set, the hash of the body must be this one
+	LinkCheck             *LinkCheck         `yaml:"link_check,omitempty"`            // if set, the same origin links of the HTML body are fetched
+	MetricAssertions      []*MetricAssertion `yaml:"metric_assertions,omitempty"`     // the body is a Prometheus metrics page and these must hold on its series
+	MetricExports         []*MetricExport    `yaml:"metric_exports,omitempty"`        // series of the Prometheus metrics page exported by the prober
+	transportsMu          *sync.Mutex
+	transports            map[string]*http.Transport // persistent transports by target, used with ReuseConnections
+	contentsMu            *sync.Mutex
+	contents              map[string]*contentState // last content hash by target, used with ContentHash
+}
+
+// WebSocketRule contains the configuration of websocket checks, the TLS, proxy and response headers
+// settings of the handshake are those of the http rule
+type WebSocketRule struct {
+	Headers        map[string]string `yaml:"headers,omitempty"`       // headers of the handshake request
+	Send           string            `yaml:"send,omitempty"`          // if set, text message sent once the websocket is open
+	ExpectRegex    string            `yaml:"expect_regexp,omitempty"` // if set, a message matching ExpectRegex must be received
+	CompiledExpect *regexp.Regexp    `yaml:"-"`
+}
+
+// SSERule contains the configuration of server-sent events checks, the TLS, proxy, statuses and
+// response headers settings of the request are those of the http rule
+type SSERule struct {
+	Headers           map[string]string `yaml:"headers,omitempty"`      // headers of the request
+	Events            int               `yaml:"events,omitempty"`       // number of events to receive before the timeout, default value is 1
+	EventTypeRegex    string            `yaml:"event_regexp,omitempty"` // if set, the type of the received events must match EventTypeRegex
+	CompiledEventType *regexp.Regexp    `yaml:"-"`
+	DataRegex         string            `yaml:"data_regexp,omitempty"` // if set, the data of the received events must match DataRegex
+	CompiledData      *regexp.Regexp    `yaml:"-"`
+}
+
+// GRPCRule contains the configuration of gRPC health checks
+type GRPCRule struct {
+	Service  string `yaml:"service,omitempty"`  // name of the service whose health is checked, default is the health of the server
+	TLS      bool   `yaml:"tls,omitempty"`      // if set, connect with TLS, otherwise with plaintext HTTP/2
+	Insecure bool   `yaml:"insecure,omitempty"` // if set, the TLS certificate is not checked
+}
+
+// UDPRule contains the configuration of UDP checks, a payload is sent and a reply is expected
+type UDPRule struct {
+	Send           string         `yaml:"send,omitempty"`          // text payload
+	SendHex        string         `yaml:"send_hex,omitempty"`      // hex payload, used instead of Send
+	ExpectRegex    string         `yaml:"expect_regexp,omitempty"` // if set, the reply must match ExpectRegex
+	CompiledExpect *regexp.Regexp `yaml:"-"`
+	ExpectHex      string         `yaml:"expect_hex,omitempty"` // if set, the reply must start with these hex bytes, ?? matches any byte
+	Retries        int            `yaml:"retries,omitempty"`    // number of times the payload is sent again if no reply is received
+
+	payload       []byte
+	expectHex     []byte
+	expectHexMask []bool
+}
+
+// TransactionRule contains the ordered list of HTTP requests of a transaction check,
+// they share a cookie jar and each request is made only if the previous ones succeeded
+type TransactionRule struct {
+	Steps []*TransactionStep `yaml:"steps"`
+}
+
+// TransactionStep is an HTTP request of a transaction, checked like the requests of http rules.
+// ${name} in its URL, header values and body is replaced by the variable captured by a previous step,
+// escaped in the URL.
+type TransactionStep struct {
+	Name     string            `yaml:"name"`
+	Method   string            `yaml:"method,omitempty"` // default value is GET
+	URL      string            `yaml:"url"`              // resolved against the URL of the target
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	Body     string            `yaml:"body,omitempty"`
+	Captures []*Capture        `yaml:"captures,omitempty"` // variables set from the response, for the next steps
+	HTTPRule `yaml:",inline"`
+}
+
+// Capture sets a variable to a value of the response of a transaction step: the first result of a jq query
+// on the body, a header value or the body. If Regex is set, the value is the first group it matches
+// in this text, or the whole match if it has no group.
+type Capture struct {
+	Name          string         `yaml:"name"`
+	JQQuery       string         `yaml:"jq_query,omitempty"`
+	Header        string         `yaml:"header,omitempty"`
+	Regex         string         `yaml:"regexp,omitempty"`
+	CompiledRegex *regexp.Regexp `yaml:"-"`
+	compiledQuery *jqQuery
+}
+
+// LinkCheck is the configuration of the check of the links and assets of an HTML page
+type LinkCheck struct {
+	Tags         []string `yaml:"tags,omitempty"`          // tags whose links are checked among a, script, link and img, default value is all of them
+	CriticalTags []string `yaml:"critical_tags,omitempty"` // a broken link of these tags fails the probe, default value is script and link
+	MaxLinks     int      `yaml:"max_links,omitempty"`     // max number of links checked, default value is 50
+	Concurrency  int      `yaml:"concurrency,omitempty"`   // number of links fetched at the same time, default value is 5
+}
+
+// MetricSelector selects the series of a metric scraped from a Prometheus metrics page
+type MetricSelector struct {
+	Name             string            `yaml:"name"`               // name of the series, like up or http_request_duration_seconds_bucket
+	Matchers         map[string]string `yaml:"matchers,omitempty"` // label name to regex the label value must fully match
+	compiledMatchers map[string]*regexp.Regexp
+}
+
+// MetricAssertion is a condition on the series of a scraped metric, at least one series must be selected
+// and all of them must respect the bounds
+type MetricAssertion struct {
+	MetricSelector    `yaml:",inline"`
+	NumericComparison `yaml:",inline"`
+}
+
+// MetricExport exports the series of a scraped metric as a metric of the prober, labeled with the target
+type MetricExport struct {
+	MetricSelector `yaml:",inline"`
+	MetricName     string   `yaml:"metric_name,omitempty"` // name of the exported metric, default value is the name of the series
+	KeepLabels     []string `yaml:"keep_labels,omitempty"` // labels of the series copied to the exported metric
+}
+
+// HeaderMatch is a regex to check against the values of a response header
+type HeaderMatch struct {
+	Header        string         `yaml:"header"`
+	Regex         string         `yaml:"regexp"`
+	AllowMissing  bool           `yaml:"allow_missing,omitempty"` // for headers_match only, a missing header is not a failure
+	CompiledRegex *regexp.Regexp `yaml:"-"`
+}
+
+// JSONAssertion is a jq query run on the HTTP response body, with the conditions its result must satisfy
+type JSONAssertion struct {
+	JQQuery           string         `yaml:"jq_query"`
+	Equals            *string        `yaml:"equals,omitempty"` // if set, the result must be equal to Equals
+	Regex             string         `yaml:"regexp,omitempty"` // if set, the result must match Regex
+	CompiledRegex     *regexp.Regexp `yaml:"-"`
+	compiledQuery     *jqQuery
+	Exists            *bool `yaml:"exists,omitempty"` // if true, the result must not be null, if false, it must be null
+	NumericComparison `yaml:",inline"`
+}
+
+// NumericComparison contains the bounds a numerical value must respect
+type NumericComparison struct {
+	GreaterThan    *float64 `yaml:"gt,omitempty"`
+	GreaterOrEqual *float64 `yaml:"ge,omitempty"`
+	LessThan       *float64 `yaml:"lt,omitempty"`
+	LessOrEqual    *float64 `yaml:"le,omitempty"`
+}
+
+func (c NumericComparison) isSet() bool {
+	return c.GreaterThan != nil || c.GreaterOrEqual != nil || c.LessThan != nil || c.LessOrEqual != nil
+}
+
+// match returns true if val respects all the bounds of the comparison
+func (c NumericComparison) match(val float64) bool {
+	if c.GreaterThan != nil && !(val > *c.GreaterThan) {
+		return false
+	}
+	if c.GreaterOrEqual != nil && !(val >= *c.GreaterOrEqual) {
+		return false
+	}
+	if c.LessThan != nil && !(val < *c.LessThan) {
+		return false
+	}
+	if c.LessOrEqual != nil && !(val <= *c.LessOrEqual) {
+		return false
+	}
+	return true
 }
 
+// PayloadExtract is a jq query extracting values from the HTTP response body into metrics.
+// Each value returned by the query becomes a series.
 type PayloadExtract struct {
-	MetricName string `yaml:"metric_name"`
-	JQQuery    string `yaml:"jq_query"`
+	MetricName  string            `yaml:"metric_name"`
+	JQQuery     string            `yaml:"jq_query"`
+	ValueQuery  string            `yaml:"value,omitempty"`  // jq query run on each value to get the metric value, default value is .
+	Labels      map[string]string `yaml:"labels,omitempty"` // label name to jq query run on each value to get the label value
+	Info        bool              `yaml:"info,omitempty"`   // if set, values are strings exported as the value label of the <metric_name>_info metric
+	labelNames  []string
+	seriesQuery *jqQuery
 }
 
 // Target is a the definition of the check to execute (which rule on which endpoint)
 type Target struct {
-	Name string
-	Addr string
-	Rule *Rule
+	Name  string
+	Addr  string
+	Rule  *Rule
+	ipsMu sync.Mutex
+	ips   map[string]bool // addresses probed by the last probe, with probe_all_ips
 }
 
 // NewTargets creates from the configuration the list of Target to be queried, and registers metrics on the way
@@ -67,6 +336,10 @@ func NewTargets(c *Configuration) ([]*Target, error) {
 		rule.tags = c.Tags
 	}
 
+	if err := checkCustomMetrics(c.Rules, c.Tags); err != nil {
+		return nil, err
+	}
+
 	targets := []*Target{}
 	for ruleName, addrs := range c.Targets {
 		rule, ok := c.Rules[ruleName]
@@ -74,16 +347,147 @@ func NewTargets(c *Configuration) ([]*Target, error) {
 			return nil, fmt.Errorf("unknown rule %s", ruleName)
 		}
 		for _, addr := range addrs {
-			targets = append(targets, &Target{
-				Name: addr,
-				Addr: addr,
-				Rule: rule,
-			})
+			expanded := []string{addr}
+			if rule.Type == "tcp" || rule.Type == "udp" {
+				var err error
+				if expanded, err = expandPorts(addr); err != nil {
+					return nil, err
+				}
+			}
+			for _, addr := range expanded {
+				targets = append(targets, &Target{
+					Name: addr,
+					Addr: addr,
+					Rule: rule,
+				})
+			}
 		}
 	}
 	return targets, nil
 }
 
+// builtinMetricNames are the names of the metrics reported by the probes, and up reported by Prometheus
+// for each scrape of the prober
+var builtinMetricNames = map[string]bool{
+	"up": true, "latency_seconds": true, "size_bytes": true, "response_code": true, checkFailedMetricName: true,
+	"status": true, "ip_protocol": true, "ips_total": true, "ips_healthy": true, "redirects": true,
+	"http_version": true, "connection_reused": true, "body_truncated": true,
+	"body_compressed_size_bytes": true, "body_uncompressed_size_bytes": true,
+	contentHashMetricName: true, "content_last_changed_timestamp": true,
+	"links_total": true, "links_broken": true, "links_critical_broken": true,
+	"link_slowest_seconds": true, slowestLinkMetricName: true,
+	"websocket_handshake_seconds": true, "websocket_round_trip_seconds": true,
+	"sse_events": true, "sse_first_event_seconds": true, "grpc_status_code": true,
+	"grpc_health_status": true, "udp_reply_received": true, "port_state_info": true,
+}
+
+// checkCustomMetrics checks that the health metrics of the rules do not use the name of a built-in metric,
+// that the metrics named in the configuration do not use the name of a built-in metric or of the health
+// metric of a rule, that their labels would not replace a tag or a label added by
+// the probes, and that a name is always used with the same label names, otherwise their samples could not
+// be exported
+func checkCustomMetrics(rules map[string]*Rule, tags map[string]string) error {
+	healthMetrics := map[string]bool{}
+	for ruleName, rule := range rules {
+		for _, prefix := range []string{"", ipMetricPrefix, stepMetricPrefix} {
+			if unprefixed := strings.TrimPrefix(rule.MetricName, prefix); builtinMetricNames[unprefixed] {
+				return fmt.Errorf("rule %s, metric name %s is reserved", ruleName, unprefixed)
+			}
+		}
+		healthMetrics[rule.MetricName] = true
+	}
+	reservedLabels := map[string]bool{urlTag: true, hostTag: true, checkTag: true, ipTag: true, stepTag: true}
+	for tag := range tags {
+		reservedLabels[tag] = true
+	}
+	labelNames := map[string][]string{}
+	for ruleName, rule := range rules {
+		metrics, err := rule.customMetrics(reservedLabels)
+		if err != nil {
+			return fmt.Errorf("rule %s, %v", ruleName, err)
+		}
+		for name, names := range metrics {
+			for _, prefix := range []string{"", ipMetricPrefix, stepMetricPrefix} {
+				unprefixed := strings.TrimPrefix(name, prefix)
+				if builtinMetricNames[unprefixed] || healthMetrics[unprefixed] {
+					return fmt.Errorf("rule %s, metric name %s is reserved", ruleName, unprefixed)
+				}
+			}
+			if previous, ok := labelNames[name]; ok && !reflect.DeepEqual(previous, names) {
+				return fmt.Errorf("rule %s, metric %s is used with labels %v and %v", ruleName, name, previous, names)
+			}
+			labelNames[name] = names
+		}
+	}
+	return nil
+}
+
+// customMetrics returns the names of the metrics extracted or exported by the rule, as reported, with the
+// sorted names of the labels added to the labels of the target. A name cannot be used twice in an http rule or step,
+// and the added labels cannot be one of reservedLabels.
+func (r *Rule) customMetrics(reservedLabels map[string]bool) (map[string][]string, error) {
+	metrics := map[string][]string{}
+	add := func(httpRule *HTTPRule, prefix string, extraLabels []string) error {
+		if httpRule == nil {
+			return nil
+		}
+		used := map[string]bool{}
+		use := func(name string, labels []string) error {
+			names := append(append([]string{}, extraLabels...), labels...)
+			sort.Strings(names)
+			if used[name] {
+				return fmt.Errorf("metric name %s is used twice", name)
+			}
+			used[name] = true
+			if previous, ok := metrics[prefix+name]; ok && !reflect.DeepEqual(previous, names) {
+				return fmt.Errorf("metric %s is used with labels %v and %v", name, previous, names)
+			}
+			metrics[prefix+name] = names
+			return nil
+		}
+		for _, p := range httpRule.PayloadExtractRules {
+			for _, labelName := range p.labelNames {
+				if reservedLabels[labelName] {
+					return fmt.Errorf("payload_extract %s cannot use reserved label %s", p.MetricName, labelName)
+				}
+			}
+			labels := p.labelNames
+			if p.Info {
+				labels = append(append([]string{}, labels...), valueTag)
+			}
+			if err := use(p.MetricName, labels); err != nil {
+				return err
+			}
+		}
+		for _, e := range httpRule.MetricExports {
+			for _, label := range e.KeepLabels {
+				if reservedLabels[label] {
+					return fmt.Errorf("metric export %s cannot keep the %s label", e.Name, label)
+				}
+			}
+			if err := use(e.MetricName, e.KeepLabels); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if r.ProbeAllIPs {
+		if err := add(r.HTTPRule, ipMetricPrefix, []string{ipTag}); err != nil {
+			return nil, err
+		}
+	} else if err := add(r.HTTPRule, "", nil); err != nil {
+		return nil, err
+	}
+	if r.TransactionRule != nil {
+		for _, step := range r.TransactionRule.Steps {
+			if err := add(&step.HTTPRule, stepMetricPrefix, []string{stepTag}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return metrics, nil
+}
+
 func (r *Rule) setup() error {
 	if r.MetricName == "" {
 		r.MetricName = DefaultMetricName
@@ -91,6 +495,63 @@ func (r *Rule) setup() error {
 	if r.Timeout == 0 {
 		r.Timeout = DefaultTimeout
 	}
+	switch r.PreferredIPProtocol {
+	case "", "ip4", "ip6":
+	default:
+		return fmt.Errorf("unsupported preferred_ip_protocol %s, expected ip4 or ip6", r.PreferredIPProtocol)
+	}
+	if r.IPProtocolFallback && r.PreferredIPProtocol == "" {
+		return fmt.Errorf("ip_protocol_fallback requires preferred_ip_protocol")
+	}
+	if r.MaxLatency < 0 || r.DegradedLatency < 0 {
+		return fmt.Errorf("max_latency and degraded_latency must be positive")
+	}
+	if r.MaxLatency > 0 && r.DegradedLatency >= r.MaxLatency {
+		return fmt.Errorf("degraded_latency must be lower than max_latency")
+	}
+	switch r.ProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("unsupported proxy_protocol %s, expected v1 or v2", r.ProxyProtocol)
+	}
+	if r.ProxyProtocol == "" && r.ProxyProtocolSource != "" {
+		return fmt.Errorf("proxy_protocol_source requires proxy_protocol")
+	}
+	if r.ProxyProtocol != "" {
+		if r.Type == "udp" || r.Type == "icmp" {
+			return fmt.Errorf("proxy_protocol is not supported by %s rules", r.Type)
+		}
+		if (r.HTTPRule != nil && r.HTTPRule.ProxyURL != "") || (r.TCPRule != nil && r.TCPRule.ProxyURL != "") {
+			return fmt.Errorf("proxy_protocol cannot be used with proxy_url")
+		}
+		if r.ProxyProtocolSource != "" {
+			var err error
+			if r.proxyProtocolSource, err = parseProxyProtocolSource(r.ProxyProtocolSource); err != nil {
+				return err
+			}
+		}
+	}
+	switch r.Expect {
+	case "", portOpen, portClosed, portRefused, portFiltered:
+	default:
+		return fmt.Errorf("unsupported expect %s, expected open, closed, refused or filtered", r.Expect)
+	}
+	if r.Expect != "" && r.Type != "tcp" && r.Type != "udp" {
+		return fmt.Errorf("expect %s is not supported by %s rules", r.Expect, r.Type)
+	}
+	if r.expectsClosed() {
+		if r.TCPRule != nil && (r.TCPRule.ProxyURL != "" || r.TCPRule.TLS || len(r.TCPRule.QueryResponse) > 0) {
+			return fmt.Errorf("expect %s cannot be used with proxy_url, tls or query_response", r.Expect)
+		}
+	}
+	if r.ProbeAllIPs {
+		if r.Type != "http" && r.Type != "tcp" && r.Type != "udp" && r.Type != "icmp" {
+			return fmt.Errorf("probe_all_ips is not supported by %s rules", r.Type)
+		}
+		if (r.HTTPRule != nil && r.HTTPRule.ProxyURL != "") || (r.TCPRule != nil && r.TCPRule.ProxyURL != "") {
+			return fmt.Errorf("probe_all_ips cannot be used with proxy_url")
+		}
+	}
 
 	switch r.Type {
 	case "http":
@@ -100,25 +561,308 @@ func (r *Rule) setup() error {
 		err := r.HTTPRule.setup()
 		return err
 	case "tcp":
+		if r.TCPRule == nil {
+			r.TCPRule = &TCPRule{}
+		}
+		return r.TCPRule.setup()
+	case "websocket":
+		if r.HTTPRule == nil {
+			r.HTTPRule = &HTTPRule{}
+		}
+		if r.WebSocketRule == nil {
+			r.WebSocketRule = &WebSocketRule{}
+		}
+		if err := r.HTTPRule.setup(); err != nil {
+			return err
+		}
+		return r.WebSocketRule.setup()
+	case "sse":
+		if r.HTTPRule == nil {
+			r.HTTPRule = &HTTPRule{}
+		}
+		if r.SSERule == nil {
+			r.SSERule = &SSERule{}
+		}
+		if err := r.HTTPRule.setup(); err != nil {
+			return err
+		}
+		return r.SSERule.setup()
+	case "grpc":
+		if r.GRPCRule == nil {
+			r.GRPCRule = &GRPCRule{}
+		}
+		if r.GRPCRule.Insecure && !r.GRPCRule.TLS {
+			return fmt.Errorf("grpc insecure requires tls")
+		}
+		return nil
+	case "udp":
+		if r.UDPRule == nil {
+			r.UDPRule = &UDPRule{}
+		}
+		return r.UDPRule.setup()
+	case "transaction":
+		if r.TransactionRule == nil {
+			return fmt.Errorf("transaction rules require a transaction")
+		}
+		return r.TransactionRule.setup()
+	case "icmp":
 		return nil
 	case "mysql":
+		if r.PreferredIPProtocol != "" || r.ProxyProtocol != "" {
+			r.mysqlNet = fmt.Sprintf("blackbox_%p", r)
+			r.mysqlIPProtocols = &sync.Map{}
+			mysql.RegisterDial(r.mysqlNet, r.dialMysql)
+		}
 		return nil
 	default:
-		return fmt.Errorf("unsupported type %s, expected http or tcp", r.Type)
+		return fmt.Errorf("unsupported type %s, expected http, tcp, udp, transaction, websocket, sse, grpc, icmp or mysql", r.Type)
+	}
+}
+
+func (r *UDPRule) setup() error {
+	if r.Send != "" && r.SendHex != "" {
+		return fmt.Errorf("udp send and send_hex cannot be used together")
+	}
+	r.payload = []byte(r.Send)
+	if r.SendHex != "" {
+		var mask []bool
+		var err error
+		r.payload, mask, err = parseHexPattern(r.SendHex)
+		if err != nil {
+			return err
+		}
+		for _, set := range mask {
+			if !set {
+				return fmt.Errorf("udp send_hex %s cannot contain ??", r.SendHex)
+			}
+		}
+	}
+	if len(r.payload) == 0 {
+		return fmt.Errorf("udp rules require send or send_hex")
+	}
+	if r.Retries < 0 {
+		return fmt.Errorf("udp retries cannot be negative")
+	}
+	if r.ExpectRegex != "" {
+		var err error
+		r.CompiledExpect, err = regexp.Compile(r.ExpectRegex)
+		if err != nil {
+			return fmt.Errorf("cannot compile regex %s, %v", r.ExpectRegex, err)
+		}
+	}
+	if r.ExpectHex != "" {
+		var err error
+		r.expectHex, r.expectHexMask, err = parseHexPattern(r.ExpectHex)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+func (r *WebSocketRule) setup() error {
+	if r.ExpectRegex != "" {
+		var err error
+		r.CompiledExpect, err = regexp.Compile(r.ExpectRegex)
+		if err != nil {
+			return fmt.Errorf("cannot compile regex %s, %v", r.ExpectRegex, err)
+		}
+	}
+	return nil
+}
+
+func (r *SSERule) setup() error {
+	if r.Events == 0 {
+		r.Events = 1
+	}
+	if r.Events < 0 {
+		return fmt.Errorf("sse events must be positive")
+	}
+	var err error
+	if r.EventTypeRegex != "" {
+		r.CompiledEventType, err = regexp.Compile(r.EventTypeRegex)
+		if err != nil {
+			return fmt.Errorf("cannot compile regex %s, %v", r.EventTypeRegex, err)
+		}
+	}
+	if r.DataRegex != "" {
+		r.CompiledData, err = regexp.Compile(r.DataRegex)
+		if err != nil {
+			return fmt.Errorf("cannot compile regex %s, %v", r.DataRegex, err)
+		}
+	}
+	return nil
+}
+
+func (r *TransactionRule) setup() error {
+	if len(r.Steps) == 0 {
+		return fmt.Errorf("transaction has no steps")
+	}
+	names := map[string]bool{}
+	vars := map[string]bool{}
+	for _, step := range r.Steps {
+		if step.Name == "" {
+			return fmt.Errorf("transaction steps require a name")
+		}
+		if names[step.Name] {
+			return fmt.Errorf("duplicate transaction step %s", step.Name)
+		}
+		names[step.Name] = true
+		if step.Method == "" {
+			step.Method = http.MethodGet
+		}
+		if step.URL == "" {
+			return fmt.Errorf("transaction step %s has no url", step.Name)
+		}
+		texts := []string{step.URL, step.Body}
+		for _, val := range step.Headers {
+			texts = append(texts, val)
+		}
+		for _, text := range texts {
+			for _, match := range varRegex.FindAllStringSubmatch(text, -1) {
+				if !vars[match[1]] {
+					return fmt.Errorf("transaction step %s uses variable %s, which is not captured by a previous step", step.Name, match[1])
+				}
+			}
+		}
+		if err := step.HTTPRule.setup(); err != nil {
+			return fmt.Errorf("transaction step %s, %v", step.Name, err)
+		}
+		for _, c := range step.Captures {
+			if err := c.setup(); err != nil {
+				return fmt.Errorf("transaction step %s, %v", step.Name, err)
+			}
+			vars[c.Name] = true
+		}
+	}
+	return nil
+}
+
+func (c *Capture) setup() error {
+	if !captureNameRegex.MatchString(c.Name) {
+		return fmt.Errorf("invalid capture name %s, expected letters, digits and underscores", c.Name)
+	}
+	if c.JQQuery != "" && c.Header != "" {
+		return fmt.Errorf("jq_query and header are mutually exclusive in capture %s", c.Name)
+	}
+	if c.JQQuery == "" && c.Header == "" && c.Regex == "" {
+		return fmt.Errorf("capture %s requires jq_query, header or regexp", c.Name)
+	}
+	var err error
+	if c.JQQuery != "" {
+		c.compiledQuery, err = compileJQ(c.JQQuery)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Regex != "" {
+		c.CompiledRegex, err = regexp.Compile(c.Regex)
+		if err != nil {
+			return fmt.Errorf("cannot compile regex %s, %v", c.Regex, err)
+		}
+	}
+	return nil
+}
+
+func (r *TCPRule) setup() error {
+	if r.ProxyURL != "" {
+		var err error
+		r.ParsedProxyURL, err = parseProxyURL(r.ProxyURL)
+		if err != nil {
+			return err
+		}
+	}
+	if r.Insecure && !r.TLS && !r.startsTLS() {
+		return fmt.Errorf("tcp insecure requires tls or a starttls step")
+	}
+	vars := map[string]bool{}
+	for i, step := range r.QueryResponse {
+		if step.StartTLS {
+			if r.TLS {
+				return fmt.Errorf("starttls cannot be used with tls")
+			}
+			if step.Expect != "" || step.Send != "" {
+				return fmt.Errorf("a starttls step cannot expect or send")
+			}
+			continue
+		}
+		if step.Expect == "" && step.Send == "" {
+			return fmt.Errorf("query_response steps require expect, send or starttls")
+		}
+		if step.Expect != "" {
+			var err error
+			step.CompiledExpect, err = regexp.Compile(step.Expect)
+			if err != nil {
+				return fmt.Errorf("cannot compile regex %s, %v", step.Expect, err)
+			}
+		}
+		if step.CompiledExpect != nil {
+			for j, name := range step.CompiledExpect.SubexpNames()[1:] {
+				vars[strconv.Itoa(j+1)] = true
+				if name != "" {
+					vars[name] = true
+				}
+			}
+		}
+		for _, match := range varRegex.FindAllStringSubmatch(step.Send, -1) {
+			if !vars[match[1]] {
+				return fmt.Errorf("query_response step %d uses variable %s, which is not captured by an expect", i+1, match[1])
+			}
+		}
+	}
+	return nil
+}
+
+func (r *TCPRule) startsTLS() bool {
+	for _, step := range r.QueryResponse {
+		if step.StartTLS {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *HTTPRule) setup() error {
+	var err error
+	r.transportsMu = &sync.Mutex{}
+	r.transports = make(map[string]*http.Transport)
+	r.contentsMu = &sync.Mutex{}
+	r.contents = make(map[string]*contentState)
+	if r.ProxyURL != "" {
+		r.ParsedProxyURL, err = parseProxyURL(r.ProxyURL)
+		if err != nil {
+			return err
+		}
+	} else if len(r.NoProxy) > 0 {
+		return fmt.Errorf("no_proxy requires proxy_url")
+	}
+	switch r.HTTPVersion {
+	case "", "1.1", "2":
+	default:
+		return fmt.Errorf("unsupported http_version %s, expected 1.1 or 2", r.HTTPVersion)
+	}
+	for _, version := range r.ValidHTTPVersions {
+		if !validHTTPVersionRegex.MatchString(version) {
+			return fmt.Errorf("invalid HTTP version %s in valid_http_versions, expected a value like HTTP/1.1 or HTTP/2.0", version)
+		}
+	}
 	if r.BodyRegex != "" {
 		if r.BodyContent != "" {
 			return fmt.Errorf("body_regexp and body_content are mutually exclusive")
 		}
-		var err error
 		r.CompiledRegex, err = regexp.Compile(r.BodyRegex)
 		if err != nil {
 			return fmt.Errorf("cannot compile regex %s, %v", r.BodyRegex, err)
 		}
 	}
+	r.CompiledMustMatch, err = compileRegexes(r.BodyMustMatch)
+	if err != nil {
+		return err
+	}
+	r.CompiledMustNotMatch, err = compileRegexes(r.BodyMustNotMatch)
+	if err != nil {
+		return err
+	}
 	if r.ValidHTTPStatuses != nil && len(r.ValidHTTPStatuses) > 0 && r.IgnoreHTTPStatus {
 		return fmt.Errorf("ignore_http_status and statuses are mutually exclusive")
 	}
@@ -128,11 +872,184 @@ func (r *HTTPRule) setup() error {
 	if r.ReadMax == 0 {
 		r.ReadMax = DefaultReadMax
 	}
+	if r.AcceptEncoding == "" {
+		r.AcceptEncoding = DefaultAcceptEncoding
+	}
+	if r.NoFollowRedirects && r.MaxRedirects > 0 {
+		return fmt.Errorf("no_follow_redirects and max_redirects are mutually exclusive")
+	}
+	if r.MaxRedirects == 0 {
+		r.MaxRedirects = DefaultMaxRedirects
+	}
+	if r.FinalURLRegex != "" {
+		r.CompiledFinalURL, err = regexp.Compile(r.FinalURLRegex)
+		if err != nil {
+			return fmt.Errorf("cannot compile regex %s, %v", r.FinalURLRegex, err)
+		}
+	}
+	if r.LocationRegex != "" {
+		r.CompiledLocation, err = regexp.Compile(r.LocationRegex)
+		if err != nil {
+			return fmt.Errorf("cannot compile regex %s, %v", r.LocationRegex, err)
+		}
+	}
+	if r.ContentHashRegex != "" {
+		r.CompiledContentHash, err = regexp.Compile(r.ContentHashRegex)
+		if err != nil {
+			return fmt.Errorf("cannot compile regex %s, %v", r.ContentHashRegex, err)
+		}
+		r.ContentHash = true
+	}
+	if r.ExpectedContentHash != "" {
+		r.ExpectedContentHash = strings.ToLower(r.ExpectedContentHash)
+		if !sha256Regex.MatchString(r.ExpectedContentHash) {
+			return fmt.Errorf("invalid expected_content_hash %s, expected a hex encoded SHA-256", r.ExpectedContentHash)
+		}
+		r.ContentHash = true
+	}
+	for _, a := range r.MetricAssertions {
+		if err := a.setup(); err != nil {
+			return err
+		}
+	}
+	for _, e := range r.MetricExports {
+		if err := e.setup(); err != nil {
+			return err
+		}
+	}
+	if r.LinkCheck != nil {
+		if err := r.LinkCheck.setup(); err != nil {
+			return err
+		}
+	}
+	for _, h := range append(r.HeadersMatch, r.HeadersNotMatch...) {
+		if err := h.setup(); err != nil {
+			return err
+		}
+	}
 	if r.PayloadExtractRule != nil {
-		if err := r.PayloadExtractRule.setup(); err != nil {
+		r.PayloadExtractRules = append([]*PayloadExtract{r.PayloadExtractRule}, r.PayloadExtractRules...)
+		r.PayloadExtractRule = nil
+	}
+	for _, p := range r.PayloadExtractRules {
+		if err := p.setup(); err != nil {
 			return err
 		}
 	}
+	for _, a := range r.JSONAssertions {
+		if err := a.setup(); err != nil {
+			return err
+		}
+	}
+	if r.needsBody() && acceptsEncoding(r.AcceptEncoding, "br") {
+		return fmt.Errorf("accept_encoding cannot request br with body checks, br bodies cannot be decoded")
+	}
+	return nil
+}
+
+func compileRegexes(regexes []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(regexes))
+	for _, regex := range regexes {
+		re, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile regex %s, %v", regex, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func (c *LinkCheck) setup() error {
+	if c.Tags == nil {
+		c.Tags = []string{"a", "script", "link", "img"}
+	}
+	if c.CriticalTags == nil {
+		c.CriticalTags = []string{"script", "link"}
+	}
+	for _, tag := range append(c.Tags, c.CriticalTags...) {
+		if _, ok := linkAttributes[tag]; !ok {
+			return fmt.Errorf("unsupported link_check tag %s, expected a, script, link or img", tag)
+		}
+	}
+	if c.MaxLinks == 0 {
+		c.MaxLinks = DefaultMaxLinks
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = DefaultLinkConcurrency
+	}
+	if c.MaxLinks < 0 || c.Concurrency < 0 {
+		return fmt.Errorf("link_check max_links and concurrency must be positive")
+	}
+	return nil
+}
+
+func (s *MetricSelector) setup() error {
+	if s.Name == "" {
+		return fmt.Errorf("metric selectors require a name")
+	}
+	s.compiledMatchers = make(map[string]*regexp.Regexp, len(s.Matchers))
+	for label, regex := range s.Matchers {
+		var err error
+		s.compiledMatchers[label], err = regexp.Compile("^(?:" + regex + ")$")
+		if err != nil {
+			return fmt.Errorf("cannot compile regex %s, %v", regex, err)
+		}
+	}
+	return nil
+}
+
+func (a *MetricAssertion) setup() error {
+	if err := a.MetricSelector.setup(); err != nil {
+		return err
+	}
+	if !a.isSet() {
+		return fmt.Errorf("metric assertion %s has no bound, expected gt, ge, lt or le", a.Name)
+	}
+	return nil
+}
+
+func (e *MetricExport) setup() error {
+	if err := e.MetricSelector.setup(); err != nil {
+		return err
+	}
+	if e.MetricName == "" {
+		e.MetricName = e.Name
+	}
+	for _, label := range e.KeepLabels {
+		if label == urlTag || label == hostTag {
+			return fmt.Errorf("metric export %s cannot keep the %s label", e.Name, label)
+		}
+	}
+	return nil
+}
+
+func (h *HeaderMatch) setup() error {
+	if h.Header == "" {
+		return fmt.Errorf("header must be non empty in headers_match and headers_not_match")
+	}
+	var err error
+	h.CompiledRegex, err = regexp.Compile(h.Regex)
+	if err != nil {
+		return fmt.Errorf("cannot compile regex %s for header %s, %v", h.Regex, h.Header, err)
+	}
+	return nil
+}
+
+func (a *JSONAssertion) setup() error {
+	if a.JQQuery == "" {
+		return fmt.Errorf("json_assertions jq_query must be non empty")
+	}
+	var err error
+	a.compiledQuery, err = compileJQ(a.JQQuery)
+	if err != nil {
+		return err
+	}
+	if a.Regex != "" {
+		a.CompiledRegex, err = regexp.Compile(a.Regex)
+		if err != nil {
+			return fmt.Errorf("cannot compile regex %s, %v", a.Regex, err)
+		}
+	}
 	return nil
 }
 
@@ -143,5 +1060,29 @@ func (p *PayloadExtract) setup() error {
 	if p.MetricName == "" {
 		return fmt.Errorf("payload_extract metric_name must be non empty")
 	}
+	if p.Info && !strings.HasSuffix(p.MetricName, infoSuffix) {
+		p.MetricName += infoSuffix
+	}
+	if p.ValueQuery == "" {
+		p.ValueQuery = "."
+	}
+	p.labelNames = []string{}
+	for labelName := range p.Labels {
+		if labelName == urlTag || labelName == hostTag || (p.Info && labelName == valueTag) {
+			return fmt.Errorf("payload_extract %s cannot use reserved label %s", p.MetricName, labelName)
+		}
+		p.labelNames = append(p.labelNames, labelName)
+	}
+	sort.Strings(p.labelNames)
+	// a single query returns, for each value, an array of the metric value followed by the label values
+	parts := []string{"(" + p.ValueQuery + ")"}
+	for _, labelName := range p.labelNames {
+		parts = append(parts, "("+p.Labels[labelName]+")")
+	}
+	var err error
+	p.seriesQuery, err = compileJQ("(" + p.JQQuery + ") | [" + strings.Join(parts, ", ") + "]")
+	if err != nil {
+		return fmt.Errorf("invalid payload_extract %s, %v", p.MetricName, err)
+	}
 	return nil
 }
@@ -0,0 +1,128 @@
+package pingers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckCustomMetrics(t *testing.T) {
+	extract := func(name string, labels map[string]string) *PayloadExtract {
+		return &PayloadExtract{MetricName: name, JQQuery: ".", Labels: labels}
+	}
+	httpRule := func(extracts ...*PayloadExtract) *HTTPRule {
+		return &HTTPRule{PayloadExtractRules: extracts}
+	}
+	exports := func(exports ...*MetricExport) *HTTPRule {
+		return &HTTPRule{MetricExports: exports}
+	}
+	export := func(name string, keepLabels ...string) *MetricExport {
+		return &MetricExport{MetricSelector: MetricSelector{Name: name}, KeepLabels: keepLabels}
+	}
+	tests := []struct {
+		name  string
+		rules map[string]*Rule
+		err   string // expected error, empty if valid
+	}{
+		{"distinct names", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: httpRule(extract("queue_depth", map[string]string{"queue": ".name"}), extract("workers", nil))},
+		}, ""},
+		{"same name and labels in two rules", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: httpRule(extract("workers", nil))},
+			"b": {Type: "http", HTTPRule: httpRule(extract("workers", nil))},
+		}, ""},
+		{"same name twice in a rule", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: httpRule(extract("workers", nil), extract("workers", map[string]string{"pool": ".pool"}))},
+		}, "used twice"},
+		{"same name with other labels in two rules", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: httpRule(extract("workers", nil))},
+			"b": {Type: "http", HTTPRule: httpRule(extract("workers", map[string]string{"pool": ".pool"}))},
+		}, "is used with labels"},
+		{"built-in name", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: httpRule(extract("check_failed", nil))},
+		}, "reserved"},
+		{"prefixed built-in name", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: httpRule(extract("ip_latency_seconds", nil))},
+		}, "reserved"},
+		{"health metric name", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: httpRule(extract("Up", nil))},
+		}, "reserved"},
+		{"label of the probes", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: httpRule(extract("queue_depth", map[string]string{"check": ".name"}))},
+		}, "reserved label"},
+		{"label of the addresses", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: httpRule(extract("queue_depth", map[string]string{"ip": ".address"}))},
+		}, "reserved label"},
+		{"label of the transaction steps", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: httpRule(extract("queue_depth", map[string]string{"step": ".name"}))},
+		}, "reserved label"},
+		{"health metric with a built-in name", map[string]*Rule{
+			"a": {Type: "http", MetricName: "latency_seconds", HTTPRule: &HTTPRule{}},
+		}, "reserved"},
+		{"health metric with a prefixed built-in name", map[string]*Rule{
+			"a": {Type: "http", MetricName: "ip_status", HTTPRule: &HTTPRule{}},
+		}, "reserved"},
+		{"health metric with a step built-in name", map[string]*Rule{
+			"a": {Type: "http", MetricName: "step_check_failed", HTTPRule: &HTTPRule{}},
+		}, "reserved"},
+		{"same name in two transaction steps", map[string]*Rule{
+			"a": {Type: "transaction", TransactionRule: &TransactionRule{Steps: []*TransactionStep{
+				{Name: "login", URL: "/login", HTTPRule: *httpRule(extract("items", nil))},
+				{Name: "list", URL: "/list", HTTPRule: *httpRule(extract("items", nil))},
+			}}},
+		}, ""},
+		{"export", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: exports(export("queue_size", "queue"))},
+			"b": {Type: "http", HTTPRule: exports(export("queue_size", "queue"))},
+		}, ""},
+		{"export with the name of an extract", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: &HTTPRule{
+				PayloadExtractRules: []*PayloadExtract{extract("queue_size", nil)},
+				MetricExports:       []*MetricExport{export("queue_size")},
+			}},
+		}, "used twice"},
+		{"exports with other labels in two rules", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: exports(export("queue_size", "queue"))},
+			"b": {Type: "http", HTTPRule: exports(export("queue_size"))},
+		}, "is used with labels"},
+		{"export with the name of an extract in another rule", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: exports(export("queue_size", "queue"))},
+			"b": {Type: "http", HTTPRule: httpRule(extract("queue_size", nil))},
+		}, "is used with labels"},
+		{"export of a built-in name", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: exports(export("latency_seconds"))},
+		}, "reserved"},
+		{"export keeping a label of the probes", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: exports(export("queue_size", "check"))},
+		}, "cannot keep the check label"},
+		{"export keeping the label of the addresses", map[string]*Rule{
+			"a": {Type: "http", ProbeAllIPs: true, HTTPRule: exports(export("queue_size", "ip"))},
+		}, "cannot keep the ip label"},
+		{"export of the health metric", map[string]*Rule{
+			"a": {Type: "http", HTTPRule: exports(export("up"))},
+		}, "reserved"},
+	}
+	for _, test := range tests {
+		_, err := NewTargets(&Configuration{Rules: test.rules})
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: got error %v, expected none", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, expected %s", test.name, err, test.err)
+		}
+	}
+
+	_, err := NewTargets(&Configuration{
+		Tags:  map[string]string{"env": "prod"},
+		Rules: map[string]*Rule{"a": {Type: "http", HTTPRule: httpRule(extract("queue_depth", map[string]string{"env": ".env"}))}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "reserved label env") {
+		t.Errorf("got error %v for a label named like a tag, expected reserved label env", err)
+	}
+	_, err = NewTargets(&Configuration{
+		Tags:  map[string]string{"env": "prod"},
+		Rules: map[string]*Rule{"a": {Type: "http", HTTPRule: exports(export("queue_size", "env"))}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "cannot keep the env label") {
+		t.Errorf("got error %v for a kept label named like a tag, expected cannot keep the env label", err)
+	}
+}
@@ -0,0 +1,49 @@
+package pingers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+const contentHashMetricName = "content_hash" + infoSuffix
+const hashTag = "hash"
+
+// contentState is the last content hash seen for a target, with the time it changed
+type contentState struct {
+	hash    string
+	changed time.Time
+}
+
+// contentHash returns the hex encoded SHA-256 of the body, or of the matches of the content hash regex
+func (r *HTTPRule) contentHash(body []byte) string {
+	h := sha256.New()
+	if r.CompiledContentHash == nil {
+		h.Write(body)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	for _, match := range r.CompiledContentHash.FindAllSubmatch(body, -1) {
+		if len(match) > 1 {
+			h.Write(match[1])
+		} else {
+			h.Write(match[0])
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// contentChanged records the content hash of the target and returns when it last changed. The first hash
+// seen for a target is not a change, the returned time is zero until the hash changes.
+func (r *HTTPRule) contentChanged(key string, hash string) time.Time {
+	r.contentsMu.Lock()
+	defer r.contentsMu.Unlock()
+	state, ok := r.contents[key]
+	if !ok {
+		state = &contentState{hash: hash}
+		r.contents[key] = state
+	} else if state.hash != hash {
+		state.hash = hash
+		state.changed = time.Now()
+	}
+	return state.changed
+}
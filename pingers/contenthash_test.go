@@ -0,0 +1,77 @@
+package pingers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestContentChanged(t *testing.T) {
+	httpRule := &HTTPRule{ContentHash: true}
+	if err := httpRule.setup(); err != nil {
+		t.Fatal(err)
+	}
+	if changed := httpRule.contentChanged("a", "hash1"); !changed.IsZero() {
+		t.Errorf("got %v for the first hash, expected no change", changed)
+	}
+	if changed := httpRule.contentChanged("a", "hash1"); !changed.IsZero() {
+		t.Errorf("got %v for the same hash, expected no change", changed)
+	}
+	if changed := httpRule.contentChanged("b", "hash2"); !changed.IsZero() {
+		t.Errorf("got %v for the first hash of another target, expected no change", changed)
+	}
+	before := time.Now()
+	first := httpRule.contentChanged("a", "hash2")
+	if first.Before(before) {
+		t.Errorf("got %v for a new hash, expected a change after %v", first, before)
+	}
+	if changed := httpRule.contentChanged("a", "hash2"); !changed.Equal(first) {
+		t.Errorf("got %v for the same hash, expected the change at %v", changed, first)
+	}
+	if changed := httpRule.contentChanged("a", "hash1"); !changed.After(first) {
+		t.Errorf("got %v for a previous hash, expected a change after %v", changed, first)
+	}
+}
+
+func TestContentLastChangedTimestamp(t *testing.T) {
+	var version atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the visitors change at each version, the status only at the first one
+		status := "ok"
+		if version.Load() > 0 {
+			status = "down"
+		}
+		fmt.Fprintf(w, "<div class=\"status\">%s</div><p>%d visitors</p>", status, version.Load())
+	}))
+	defer server.Close()
+	r := &Rule{Type: "http", HTTPRule: &HTTPRule{ContentHash: true, ContentHashRegex: `<div class="status">(.*?)</div>`}}
+	if err := r.setup(); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(server.URL)
+	key := "content_last_changed_timestamp" + labelsKey(urlLabels(u, nil))
+
+	reporter := newFakeReporter()
+	pingerHTTP(server.URL, reporter, r)
+	pingerHTTP(server.URL, reporter, r)
+	if got, ok := reporter.values[key]; ok {
+		t.Errorf("got content_last_changed_timestamp %v, expected none before a change", got)
+	}
+	version.Store(1)
+	before := time.Now().Unix()
+	pingerHTTP(server.URL, reporter, r)
+	changed, ok := reporter.values[key]
+	if !ok || changed < float64(before) {
+		t.Errorf("got content_last_changed_timestamp %v, expected the time of the change", changed)
+	}
+	time.Sleep(time.Second)
+	version.Store(2)
+	pingerHTTP(server.URL, reporter, r)
+	if got := reporter.values[key]; got != changed {
+		t.Errorf("got content_last_changed_timestamp %v, expected %v with the same status", got, changed)
+	}
+}
@@ -0,0 +1,124 @@
+package pingers
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// lookupIP resolves host names, replaced in tests
+var lookupIP = net.DefaultResolver.LookupIP
+
+// resolveIP resolves host with the preferred IP protocol of the rule,
+// falling back to the other protocol if allowed and no address was found
+func (r *Rule) resolveIP(ctx context.Context, host string) (net.IP, error) {
+	if r.targetIP != nil && host == r.targetHost {
+		return r.targetIP, nil
+	}
+	ips, err := r.resolveIPs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// resolveIPs returns all the addresses of host for the preferred IP protocol of the rule, or for both
+// protocols if none, falling back to the other protocol if allowed and no address was found
+func (r *Rule) resolveIPs(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	protocols := []string{"ip"}
+	if r.PreferredIPProtocol != "" {
+		protocols = []string{r.PreferredIPProtocol}
+	}
+	if r.IPProtocolFallback {
+		if r.PreferredIPProtocol == "ip4" {
+			protocols = append(protocols, "ip6")
+		} else {
+			protocols = append(protocols, "ip4")
+		}
+	}
+	var err error
+	for _, protocol := range protocols {
+		var ips []net.IP
+		ips, err = lookupIP(ctx, protocol, host)
+		if err == nil && len(ips) > 0 {
+			return ips, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot resolve %s with %v, %v", host, protocols, err)
+}
+
+// dialContext connects to addr, resolving its host with the preferred IP protocol of the rule if any.
+// The target host of a rule probing a single address is always reached at this address.
+// The PROXY protocol header of the rule, if any, is sent once connected.
+func (r *Rule) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := r.dial(ctx, network, addr)
+	if err != nil || r.ProxyProtocol == "" {
+		return conn, err
+	}
+	if err := r.writeProxyHeader(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot send PROXY protocol header to %s, %v", addr, err)
+	}
+	return conn, nil
+}
+
+func (r *Rule) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if r.PreferredIPProtocol == "" && r.targetIP == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.PreferredIPProtocol == "" && host != r.targetHost {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	ip, err := r.resolveIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+}
+
+// targetKey identifies the target addr, and its address when the rule probes a single address of the target
+func (r *Rule) targetKey(addr string) string {
+	if r.targetIP == nil {
+		return addr
+	}
+	return ipTargetKey(addr, r.targetIP.String())
+}
+
+// ipTargetKey returns the key of the state kept for one of the addresses of a target, with probe_all_ips
+func ipTargetKey(addr string, ip string) string {
+	return addr + " " + ip
+}
+
+// ipProtocol returns 4 or 6 depending on the IP protocol of addr, 0 if addr is not an IP address
+func ipProtocol(addr net.Addr) int {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return ipVersion(net.ParseIP(host))
+}
+
+func ipVersion(ip net.IP) int {
+	switch {
+	case ip == nil:
+		return 0
+	case ip.To4() != nil:
+		return 4
+	}
+	return 6
+}
+
+// reportIPProtocol reports the IP protocol used by a probe, if known
+func reportIPProtocol(version int, reporter MetricReporter, labels map[string]string) {
+	if version != 0 {
+		reporter.ReportValue(float64(version), "ip_protocol", labels)
+	}
+}
@@ -0,0 +1,91 @@
+package pingers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeLookupIP replaces lookupIP by a resolver returning the given addresses of each IP protocol,
+// until the test ends
+func fakeLookupIP(t *testing.T, v4 []string, v6 []string) {
+	lookup := lookupIP
+	t.Cleanup(func() { lookupIP = lookup })
+	lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		addrs := map[string][]string{"ip4": v4, "ip6": v6, "ip": append(append([]string{}, v6...), v4...)}[network]
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no %s address for %s", network, host)
+		}
+		ips := []net.IP{}
+		for _, addr := range addrs {
+			ips = append(ips, net.ParseIP(addr))
+		}
+		return ips, nil
+	}
+}
+
+func TestResolveIP(t *testing.T) {
+	tests := []struct {
+		name   string
+		v4, v6 []string
+		rule   *Rule
+		want   string // empty if the host cannot be resolved
+	}{
+		{"ip4", []string{"192.0.2.1"}, []string{"2001:db8::1"}, &Rule{PreferredIPProtocol: "ip4"}, "192.0.2.1"},
+		{"ip6", []string{"192.0.2.1"}, []string{"2001:db8::1"}, &Rule{PreferredIPProtocol: "ip6"}, "2001:db8::1"},
+		{"any protocol", []string{"192.0.2.1"}, []string{"2001:db8::1"}, &Rule{}, "2001:db8::1"},
+		{"ip6 fallback to ip4", []string{"192.0.2.1"}, nil, &Rule{PreferredIPProtocol: "ip6", IPProtocolFallback: true}, "192.0.2.1"},
+		{"ip4 fallback to ip6", nil, []string{"2001:db8::1"}, &Rule{PreferredIPProtocol: "ip4", IPProtocolFallback: true}, "2001:db8::1"},
+		{"ip6 without fallback", []string{"192.0.2.1"}, nil, &Rule{PreferredIPProtocol: "ip6"}, ""},
+		{"ip4 without fallback", nil, []string{"2001:db8::1"}, &Rule{PreferredIPProtocol: "ip4"}, ""},
+	}
+	for _, test := range tests {
+		fakeLookupIP(t, test.v4, test.v6)
+		ip, err := test.rule.resolveIP(context.Background(), "dual.test")
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("%s: got %v, expected an error", test.name, ip)
+		case test.want != "" && (err != nil || ip.String() != test.want):
+			t.Errorf("%s: got %v, %v, expected %s", test.name, ip, err, test.want)
+		}
+	}
+}
+
+func TestDialContextPreferredIPProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	addr := net.JoinHostPort("dual.test", port)
+	// the IPv6 address is unreachable, the IPv4 one is the listener
+	fakeLookupIP(t, []string{"127.0.0.1"}, []string{"100::1"})
+
+	conn, err := (&Rule{PreferredIPProtocol: "ip4"}).dialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("got %v with ip4, expected to reach 127.0.0.1", err)
+	}
+	if remote := conn.RemoteAddr().(*net.TCPAddr); !remote.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("got a connection to %v with ip4, expected 127.0.0.1", remote)
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if conn, err := (&Rule{PreferredIPProtocol: "ip6"}).dialContext(ctx, "tcp", addr); err == nil {
+		conn.Close()
+		t.Errorf("got a connection to %v with ip6, expected the IPv6 address to be dialed", conn.RemoteAddr())
+	}
+}
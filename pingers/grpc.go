@@ -0,0 +1,157 @@
+package pingers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// grpcHealthCheckPath is the path of the Check method of the standard gRPC health service
+const grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+
+// grpcServing is the SERVING status of grpc.health.v1.HealthCheckResponse
+const grpcServing = 1
+
+// grpcMaxMessageSize is the max size of a health check response
+const grpcMaxMessageSize = 1 << 20
+
+// healthCheckRequest is the grpc.health.v1.HealthCheckRequest message
+type healthCheckRequest struct {
+	Service string `protobuf:"bytes,1,opt,name=service,proto3"`
+}
+
+func (m *healthCheckRequest) Reset()         { *m = healthCheckRequest{} }
+func (m *healthCheckRequest) String() string { return proto.CompactTextString(m) }
+func (*healthCheckRequest) ProtoMessage()    {}
+
+// healthCheckResponse is the grpc.health.v1.HealthCheckResponse message
+type healthCheckResponse struct {
+	Status int32 `protobuf:"varint,1,opt,name=status,proto3"`
+}
+
+func (m *healthCheckResponse) Reset()         { *m = healthCheckResponse{} }
+func (m *healthCheckResponse) String() string { return proto.CompactTextString(m) }
+func (*healthCheckResponse) ProtoMessage()    {}
+
+// pingerGRPC calls the Check method of the gRPC health service at addr, a host:port.
+// The probe succeeds if the call succeeds and the service is SERVING.
+func pingerGRPC(addr string, reporter MetricReporter, c *Rule) error {
+	labels := addrLabel(addr, c.tags)
+	grpcRule := c.GRPCRule
+	payload, err := proto.Marshal(&healthCheckRequest{Service: grpcRule.Service})
+	if err != nil {
+		log.Printf("cannot encode health check request, %v\n", err)
+		reporter.ReportSuccess(false, c.MetricName, labels)
+		return err
+	}
+	// gRPC messages are prefixed by a compressed flag and their length
+	message := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(message[1:], uint32(len(payload)))
+	message = append(message, payload...)
+
+	scheme := "http"
+	if grpcRule.TLS {
+		scheme = "https"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(c.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, scheme+"://"+addr+grpcHealthCheckPath, bytes.NewReader(message))
+	if err != nil {
+		log.Printf("cannot create request for %s, %v\n", addr, err)
+		reporter.ReportSuccess(false, c.MetricName, labels)
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	client := &http.Client{Transport: newGRPCTransport(c)}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Couldn't call health check of %s: %v", addr, err)
+		reporter.ReportSuccess(false, c.MetricName, labels)
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, grpcMaxMessageSize))
+	if err != nil {
+		log.Printf("Couldn't read health check response of %s: %v", addr, err)
+		reporter.ReportSuccess(false, c.MetricName, labels)
+		return err
+	}
+	reporter.ReportLatency(time.Since(start).Seconds(), labels)
+	reporter.ReportHttpStatus(resp.StatusCode, labels)
+
+	// the status is in the trailers, or in the headers of responses without message
+	trailer := resp.Trailer
+	if trailer.Get("Grpc-Status") == "" {
+		trailer = resp.Header
+	}
+	status := trailer.Get("Grpc-Status")
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		log.Printf("invalid grpc-status %q from %s", status, addr)
+		reporter.ReportSuccess(false, c.MetricName, labels)
+		return fmt.Errorf("invalid grpc-status %q", status)
+	}
+	reporter.ReportValue(float64(code), "grpc_status_code", labels)
+	checks := []check{{"grpc_status", code == 0}}
+	if code != 0 {
+		log.Printf("health check of %s failed with grpc-status %d: %s", addr, code, trailer.Get("Grpc-Message"))
+	} else {
+		response := &healthCheckResponse{}
+		err := decodeGRPCMessage(body, response)
+		if err != nil {
+			log.Printf("cannot decode health check response of %s, %v", addr, err)
+		} else {
+			reporter.ReportValue(float64(response.Status), "grpc_health_status", labels)
+		}
+		checks = append(checks, check{"serving", err == nil && response.Status == grpcServing})
+	}
+	ok := reportChecks(checks, addr, reporter, labels)
+	reporter.ReportSuccess(ok, c.MetricName, labels)
+	return nil
+}
+
+// newGRPCTransport returns an HTTP/2 transport, over TLS or plaintext depending on the rule
+func newGRPCTransport(r *Rule) *http.Transport {
+	transport := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: r.GRPCRule.Insecure},
+		DisableKeepAlives: true,
+		DialContext:       r.dialContext,
+		ForceAttemptHTTP2: true,
+	}
+	protocols := &http.Protocols{}
+	if r.GRPCRule.TLS {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	transport.Protocols = protocols
+	return transport
+}
+
+// decodeGRPCMessage decodes the single length prefixed message of a gRPC response body
+func decodeGRPCMessage(body []byte, msg proto.Message) error {
+	if len(body) < 5 {
+		return fmt.Errorf("response has no message")
+	}
+	if body[0] != 0 {
+		return fmt.Errorf("compressed responses are not supported")
+	}
+	length := binary.BigEndian.Uint32(body[1:5])
+	if uint32(len(body)-5) < length {
+		return fmt.Errorf("truncated message")
+	}
+	return proto.Unmarshal(body[5:5+length], msg)
+}
@@ -0,0 +1,89 @@
+package pingers
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// grpcHealthServer is a plaintext HTTP/2 server implementing the health check, the status of a service is
+// its name, SERVING or NOT_SERVING, and other services are not found
+func grpcHealthServer(t *testing.T) string {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		request := &healthCheckRequest{}
+		if req.ProtoMajor != 2 || req.URL.Path != grpcHealthCheckPath || req.Header.Get("Content-Type") != "application/grpc" ||
+			decodeGRPCMessage(body, request) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		var status int32
+		switch request.Service {
+		case "SERVING":
+			status = grpcServing
+		case "NOT_SERVING":
+			status = 2
+		default:
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "5")
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", "unknown service")
+			return
+		}
+		payload, _ := proto.Marshal(&healthCheckResponse{Status: status})
+		message := make([]byte, 5, 5+len(payload))
+		binary.BigEndian.PutUint32(message[1:], uint32(len(payload)))
+		w.Write(append(message, payload...))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	server.Config.Protocols = &http.Protocols{}
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestPingerGRPC(t *testing.T) {
+	addr := grpcHealthServer(t)
+	labels := addrLabel(addr, nil)
+	tests := []struct {
+		service string
+		up      float64
+		values  map[string]float64 // expected series, by metric name and check
+	}{
+		{"SERVING", 1, map[string]float64{"grpc_status_code": 0, "grpc_health_status": 1, "grpc_status": 0, "serving": 0}},
+		{"NOT_SERVING", 0, map[string]float64{"grpc_status_code": 0, "grpc_health_status": 2, "grpc_status": 0, "serving": 1}},
+		{"unknown", 0, map[string]float64{"grpc_status_code": 5, "grpc_status": 1}},
+	}
+	for _, test := range tests {
+		r := &Rule{Type: "grpc", GRPCRule: &GRPCRule{Service: test.service}}
+		if err := r.setup(); err != nil {
+			t.Fatal(err)
+		}
+		reporter := NewReporter("", nil)
+		if err := pingerGRPC(addr, reporter, r); err != nil {
+			t.Errorf("%s: %v", test.service, err)
+			continue
+		}
+		values := collect(t, reporter)
+		if values[DefaultMetricName+labelsKey(labels)] != test.up {
+			t.Errorf("%s: got %v, expected %s %v", test.service, values, DefaultMetricName, test.up)
+		}
+		if _, ok := values["grpc_health_status"+labelsKey(labels)]; ok != (test.values["grpc_health_status"] != 0) {
+			t.Errorf("%s: got %v, expected grpc_health_status only for a response message", test.service, values)
+		}
+		for name, want := range test.values {
+			key := name + labelsKey(labels)
+			if name == "grpc_status" || name == "serving" {
+				key = checkFailedMetricName + labelsKey(withLabel(labels, checkTag, name))
+			}
+			if got, ok := values[key]; !ok || got != want {
+				t.Errorf("%s: got %v, expected %s to be %v", test.service, values, key, want)
+			}
+		}
+	}
+}
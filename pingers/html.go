@@ -0,0 +1,135 @@
+package pingers
+
+import (
+	"bytes"
+	"html"
+	"strings"
+)
+
+// htmlTag is a start tag of an HTML document with its attributes, names are lower case
+type htmlTag struct {
+	name  string
+	attrs map[string]string
+}
+
+// rawTextTags are the tags whose content is not HTML
+var rawTextTags = map[string]bool{"script": true, "style": true, "textarea": true, "title": true}
+
+// htmlTags returns the start tags of an HTML document. It is a lenient scanner, not a full parser:
+// comments, doctypes, end tags and the content of raw text tags like script are skipped.
+func htmlTags(doc []byte) []htmlTag {
+	tags := []htmlTag{}
+	i := 0
+	for {
+		start := bytes.IndexByte(doc[i:], '<')
+		if start < 0 {
+			return tags
+		}
+		i += start + 1
+		switch {
+		case bytes.HasPrefix(doc[i:], []byte("!--")):
+			i = skipPast(doc, i+3, "-->")
+			continue
+		case i < len(doc) && (doc[i] == '!' || doc[i] == '?' || doc[i] == '/'):
+			i = skipPast(doc, i, ">")
+			continue
+		}
+		nameEnd := i
+		for nameEnd < len(doc) && isTagNameChar(doc[nameEnd]) {
+			nameEnd++
+		}
+		if nameEnd == i || !isLetter(doc[i]) {
+			continue
+		}
+		tag := htmlTag{name: strings.ToLower(string(doc[i:nameEnd])), attrs: map[string]string{}}
+		i = parseAttributes(doc, nameEnd, tag.attrs)
+		tags = append(tags, tag)
+		if rawTextTags[tag.name] {
+			end := bytes.Index(bytes.ToLower(doc[i:]), []byte("</"+tag.name))
+			if end < 0 {
+				return tags
+			}
+			i += end
+		}
+	}
+}
+
+// parseAttributes parses the attributes of a tag starting at i, and returns the index after the tag
+func parseAttributes(doc []byte, i int, attrs map[string]string) int {
+	for i < len(doc) {
+		for i < len(doc) && isSpace(doc[i]) {
+			i++
+		}
+		if i >= len(doc) {
+			return i
+		}
+		if doc[i] == '>' {
+			return i + 1
+		}
+		if doc[i] == '/' {
+			i++
+			continue
+		}
+		nameStart := i
+		for i < len(doc) && !isSpace(doc[i]) && doc[i] != '=' && doc[i] != '>' && doc[i] != '/' {
+			i++
+		}
+		name := strings.ToLower(string(doc[nameStart:i]))
+		for i < len(doc) && isSpace(doc[i]) {
+			i++
+		}
+		if i >= len(doc) || doc[i] != '=' {
+			if _, ok := attrs[name]; !ok {
+				attrs[name] = ""
+			}
+			continue
+		}
+		i++
+		for i < len(doc) && isSpace(doc[i]) {
+			i++
+		}
+		var value string
+		if i < len(doc) && (doc[i] == '"' || doc[i] == '\'') {
+			end := bytes.IndexByte(doc[i+1:], doc[i])
+			if end < 0 {
+				return len(doc)
+			}
+			value = string(doc[i+1 : i+1+end])
+			i += end + 2
+		} else {
+			valueStart := i
+			for i < len(doc) && !isSpace(doc[i]) && doc[i] != '>' {
+				i++
+			}
+			value = string(doc[valueStart:i])
+		}
+		if _, ok := attrs[name]; !ok {
+			attrs[name] = html.UnescapeString(value)
+		}
+	}
+	return i
+}
+
+// skipPast returns the index after the first occurrence of end in doc from i, or the end of doc
+func skipPast(doc []byte, i int, end string) int {
+	if i > len(doc) {
+		return len(doc)
+	}
+	n := bytes.Index(doc[i:], []byte(end))
+	if n < 0 {
+		return len(doc)
+	}
+	return i + n + len(end)
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isTagNameChar(c byte) bool {
+	return isLetter(c) || (c >= '0' && c <= '9') || c == '-'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
@@ -0,0 +1,63 @@
+package pingers
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestHTMLTags(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want []htmlTag
+	}{
+		{`<a href="/a">`, []htmlTag{{"a", map[string]string{"href": "/a"}}}},
+		{`<a href='/a b'>`, []htmlTag{{"a", map[string]string{"href": "/a b"}}}},
+		{`<a href=/a>`, []htmlTag{{"a", map[string]string{"href": "/a"}}}},
+		{`<A HREF = "/a" Target=_blank>`, []htmlTag{{"a", map[string]string{"href": "/a", "target": "_blank"}}}},
+		{`<a title='say "hi"' href="/a?x=1&amp;y=2">`, []htmlTag{{"a", map[string]string{"title": `say "hi"`, "href": "/a?x=1&y=2"}}}},
+		{`<script async src="/s.js"></script>`, []htmlTag{{"script", map[string]string{"async": "", "src": "/s.js"}}}},
+		{`<img src="/a.png"/><br/>`, []htmlTag{{"img", map[string]string{"src": "/a.png"}}, {"br", map[string]string{}}}},
+		{`<a href="/a" href="/b">`, []htmlTag{{"a", map[string]string{"href": "/a"}}}},
+		{`<a href="/unterminated>`, []htmlTag{{"a", map[string]string{}}}},
+		{`<!-- <a href="/hidden"> --><a href="/a">`, []htmlTag{{"a", map[string]string{"href": "/a"}}}},
+		{`<!-- unterminated <a href="/hidden">`, []htmlTag{}},
+		{`<!DOCTYPE html><?xml version="1.0"?></div><p>`, []htmlTag{{"p", map[string]string{}}}},
+		{`<script>if (a <b) document.write("<a href='/x'>")</script><a href="/a">`,
+			[]htmlTag{{"script", map[string]string{}}, {"a", map[string]string{"href": "/a"}}}},
+		{`1 < 2 <3 <a href="/a">`, []htmlTag{{"a", map[string]string{"href": "/a"}}}},
+	}
+	for _, test := range tests {
+		if got := htmlTags([]byte(test.doc)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("htmlTags(%s) = %v, expected %v", test.doc, got, test.want)
+		}
+	}
+}
+
+func TestPageLinks(t *testing.T) {
+	pageURL, _ := url.Parse("http://example.com/dir/page.html")
+	linkCheck := &LinkCheck{Tags: []string{"a", "script", "link", "img"}, MaxLinks: 10}
+	tests := []struct {
+		doc  string
+		want []string
+	}{
+		{`<a href="a.html"><img src="/img.png"><a href="a.html#top">`,
+			[]string{"http://example.com/dir/a.html", "http://example.com/img.png"}},
+		{`<base href="/other/"><a href="a.html">`, []string{"http://example.com/other/a.html"}},
+		{`<base href="http://cdn.example.com/"><a href="a.html"><a href="/b.html">`, []string{}},
+		{`<base target="_blank"><a href="a.html">`, []string{"http://example.com/dir/a.html"}},
+		{`<!-- <base href="/other/"> --><a href="a.html">`, []string{"http://example.com/dir/a.html"}},
+		{`<a href="http://other.com/"><a href="mailto:a@example.com"><a href="javascript:void(0)">`, []string{}},
+		{`<link rel="stylesheet" href="s.css"><link rel="canonical" href="c.html"><link rel="Preload Icon" href="i.png">`,
+			[]string{"http://example.com/dir/s.css", "http://example.com/dir/i.png"}},
+	}
+	for _, test := range tests {
+		got := []string{}
+		for _, l := range pageLinks([]byte(test.doc), pageURL, linkCheck) {
+			got = append(got, l.url.String())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("pageLinks(%s) = %v, expected %v", test.doc, got, test.want)
+		}
+	}
+}
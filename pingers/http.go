@@ -2,14 +2,17 @@ package pingers
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
-	"os/exec"
 	"strconv"
 	"strings"
 	"time"
@@ -20,87 +23,387 @@ func pingerHTTP(urlStr string, reporter MetricReporter, r *Rule) error {
 	URL, err := url.Parse(urlStr)
 	if err != nil {
 		log.Printf("cannot parse url %s, %v\n", urlStr, err)
-		reporter.ReportSuccess(false, r.MetricName, map[string]string{})
+		reporter.ReportSuccess(false, r.MetricName, pingerLabels(urlStr, "", r.tags))
 		return err
 	}
+	req, err := http.NewRequest(http.MethodGet, urlStr, nil)
+	if err != nil {
+		log.Printf("cannot create request for %s, %v\n", urlStr, err)
+		reporter.ReportSuccess(false, r.MetricName, urlLabels(URL, r.tags))
+		return err
+	}
+	_, err = probeHTTP(req, reporter, urlLabels(URL, r.tags), r, nil, nil)
+	return err
+}
 
+// probeHTTP sends req with the settings of the http rule of r, then reports the metrics and checks of the response.
+// If set, the client uses jar and moreChecks returns checks made on the response in addition to those of the rule.
+// It returns true if all the checks passed.
+func probeHTTP(req *http.Request, reporter MetricReporter, labels map[string]string, r *Rule,
+	jar http.CookieJar, moreChecks func(resp *http.Response, body []byte) []check) (bool, error) {
+
+	urlStr := req.URL.String()
 	httpRule := r.HTTPRule
 	metricName := r.MetricName
+	redirects := 0
+	tooManyRedirects := false
 	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig:   &tls.Config{InsecureSkipVerify: httpRule.Insecure},
-			DisableKeepAlives: true,
+		Transport: httpRule.transport(urlStr, r),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if httpRule.NoFollowRedirects {
+				return http.ErrUseLastResponse
+			}
+			if len(via) > httpRule.MaxRedirects {
+				tooManyRedirects = true
+				return http.ErrUseLastResponse
+			}
+			redirects = len(via)
+			return nil
 		},
+		Jar:     jar,
 		Timeout: time.Second * time.Duration(r.Timeout),
 	}
+	reused := false
+	gotConn := false
+	ipVersion := 0
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !gotConn {
+				gotConn = true
+				reused = info.Reused
+				ipVersion = ipProtocol(info.Conn.RemoteAddr())
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	// setting Accept-Encoding disables the transparent decompression of the transport,
+	// so that the size of the body on the wire can be measured
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", httpRule.AcceptEncoding)
+	}
 	start := time.Now()
-	resp, err := client.Get(urlStr)
+	resp, err := client.Do(req)
+	if httpRule.ParsedProxyURL != nil {
+		reportChecks([]check{{"proxy", err == nil || !isProxyError(err)}}, urlStr, reporter, labels)
+	}
 	if err != nil {
 		log.Printf("Couldn't get %s: %v", urlStr, err)
-		reporter.ReportSuccess(false, metricName, urlLabels(URL, r.tags))
-		return err
+		reporter.ReportSuccess(false, metricName, labels)
+		return false, err
 	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, httpRule.ReadMax))
+	wire := &countingReader{r: resp.Body}
+	encoding := contentEncoding(resp.Header.Get("Content-Encoding"))
+	decoded, decodeErr := decodeBody(wire, encoding)
+	if decodeErr != nil {
+		log.Printf("Couldn't decode HTTP body for %s: %v", urlStr, decodeErr)
+		_, err = io.Copy(ioutil.Discard, io.LimitReader(wire, httpRule.ReadMax))
+		// body assertions are evaluated on an empty body
+		decoded = bytes.NewReader(nil)
+	}
+	var streamed *streamedBody
+	if err == nil {
+		streamed, err = readBody(decoded, httpRule, httpRule.keepsBody() || moreChecks != nil)
+	}
 	if err != nil {
 		log.Printf("Couldn't read HTTP body for %s: %v", urlStr, err)
-		reporter.ReportSuccess(false, metricName, urlLabels(URL, r.tags))
-		return err
+		reporter.ReportSuccess(false, metricName, labels)
+		return false, err
 	}
-	size := len(body)
-	reporter.ReportLatency(time.Since(start).Seconds(), urlLabels(URL, r.tags))
-	reporter.ReportSize(size, urlLabels(URL, r.tags))
-	reporter.ReportHttpStatus(resp.StatusCode, urlLabels(URL, r.tags))
+	body := streamed.body
+	size := streamed.size
+	reporter.ReportLatency(time.Since(start).Seconds(), labels)
+	reporter.ReportSize(size, labels)
+	reporter.ReportValue(float64(wire.n), "body_compressed_size_bytes", labels)
+	if decodeErr == nil {
+		reporter.ReportValue(float64(size), "body_uncompressed_size_bytes", labels)
+		reporter.ReportSuccess(streamed.truncated, "body_truncated", labels)
+	}
+	reporter.ReportHttpStatus(resp.StatusCode, labels)
+	reporter.ReportValue(float64(redirects), "redirects", labels)
+	if httpRule.ReuseConnections {
+		reporter.ReportSuccess(reused, "connection_reused", labels)
+	}
+	reporter.ReportValue(float64(resp.ProtoMajor)+float64(resp.ProtoMinor)/10, "http_version", labels)
+	reportIPProtocol(ipVersion, reporter, labels)
 
-	match := matchBody(body, httpRule)
-	validStatus := validStatus(resp.StatusCode, httpRule)
+	checks := []check{
+		{"status", validStatus(resp.StatusCode, httpRule)},
+		{"body", streamed.contentOK},
+		{"max_redirects", !tooManyRedirects},
+		{"content_decoding", decodeErr == nil || (decodeErr == errUnsupportedEncoding && !httpRule.needsBody())},
+	}
+	if len(httpRule.ValidContentEncodings) > 0 {
+		checks = append(checks, check{"valid_content_encodings", validContentEncoding(encoding, httpRule)})
+	}
+	if httpRule.CompiledFinalURL != nil {
+		checks = append(checks, check{"final_url", httpRule.CompiledFinalURL.MatchString(resp.Request.URL.String())})
+	}
+	if httpRule.CompiledLocation != nil {
+		checks = append(checks, check{"location", httpRule.CompiledLocation.MatchString(resp.Header.Get("Location"))})
+	}
+	if httpRule.HTTPVersion == "2" {
+		checks = append(checks, check{"http_version", resp.ProtoMajor == 2})
+	}
+	if len(httpRule.ValidHTTPVersions) > 0 {
+		checks = append(checks, check{"valid_http_versions", validHTTPVersion(resp.Proto, httpRule)})
+	}
+	checks = append(checks, matchHeaders(resp.Header, httpRule)...)
+	checks = append(checks, matchBodyRegexes(streamed, httpRule)...)
+	if httpRule.FailOnTruncation {
+		checks = append(checks, check{"body_truncated", !streamed.truncated})
+	}
+	checks = append(checks, matchJSON(body, httpRule)...)
+	if httpRule.ContentHash && decodeErr == nil {
+		hash := httpRule.contentHash(body)
+		changed := httpRule.contentChanged(r.targetKey(urlStr), hash)
+		reporter.ReportInfo(contentHashMetricName, labels, map[string]string{hashTag: hash})
+		if !changed.IsZero() {
+			reporter.ReportValue(float64(changed.Unix()), "content_last_changed_timestamp", labels)
+		}
+		if httpRule.ExpectedContentHash != "" {
+			checks = append(checks, check{"content_hash", hash == httpRule.ExpectedContentHash})
+		}
+	}
+	if (len(httpRule.MetricAssertions) > 0 || len(httpRule.MetricExports) > 0) && decodeErr == nil {
+		checks = append(checks, scrapeMetrics(body, httpRule, reporter, labels)...)
+	}
+	if httpRule.LinkCheck != nil && decodeErr == nil {
+		checks = append(checks, check{"links", checkLinks(body, resp.Request.URL, start.Add(client.Timeout), reporter, labels, r)})
+	}
+	if moreChecks != nil {
+		checks = append(checks, moreChecks(resp, body)...)
+	}
 
-	ok := match && validStatus
-	if ok && httpRule.PayloadExtractRule != nil {
-		val, err := extractValue(body, httpRule)
-		if err != nil {
-			fmt.Printf("cannot extract value from HTTP response, %v\n", err)
-		} else {
-			reporter.ReportValue(val, httpRule.PayloadExtractRule.MetricName, urlLabels(URL, r.tags))
+	ok := reportChecks(checks, urlStr, reporter, labels)
+	if !ok && streamed.truncated {
+		log.Printf("body of %s was truncated to read_max %d bytes", urlStr, httpRule.ReadMax)
+	}
+	if ok {
+		for _, extract := range httpRule.PayloadExtractRules {
+			err := extractValues(body, extract, reporter, labels)
+			if err != nil {
+				fmt.Printf("cannot extract %s from HTTP response, %v\n", extract.MetricName, err)
+			}
 		}
 	}
-	reporter.ReportSuccess(ok, metricName, urlLabels(URL, r.tags))
-	return nil
+	reporter.ReportSuccess(ok, metricName, labels)
+	return ok, nil
+}
+
+// transport returns the transport to probe urlStr with. With ReuseConnections, the transport
+// of the target is created once and kept between probes, otherwise a new transport is returned.
+func (r *HTTPRule) transport(urlStr string, rule *Rule) *http.Transport {
+	if !r.ReuseConnections {
+		return newHTTPTransport(rule)
+	}
+	r.transportsMu.Lock()
+	defer r.transportsMu.Unlock()
+	key := rule.targetKey(urlStr)
+	transport, ok := r.transports[key]
+	if !ok {
+		transport = newHTTPTransport(rule)
+		transport.DisableKeepAlives = false
+		r.transports[key] = transport
+	}
+	return transport
+}
+
+// forgetTarget deletes the state kept for a target between probes: its persistent transport, whose idle
+// connections are closed, and its last content hash
+func (r *HTTPRule) forgetTarget(key string) {
+	r.transportsMu.Lock()
+	if transport, ok := r.transports[key]; ok {
+		transport.CloseIdleConnections()
+		delete(r.transports, key)
+	}
+	r.transportsMu.Unlock()
+	r.contentsMu.Lock()
+	delete(r.contents, key)
+	r.contentsMu.Unlock()
+}
+
+// newHTTPTransport returns a transport without keep-alive, configured with the TLS, HTTP version and proxy settings of the rule.
+// HTTP/2 is only attempted if the rule requires or accepts it.
+func newHTTPTransport(r *Rule) *http.Transport {
+	httpRule := r.HTTPRule
+	transport := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: httpRule.Insecure},
+		DisableKeepAlives: true,
+		DialContext:       r.dialContext,
+	}
+	switch {
+	case httpRule.HTTPVersion == "1.1":
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	case httpRule.HTTPVersion == "2":
+		// HTTP/2 is negotiated over TLS, and used with prior knowledge on http:// URLs
+		transport.Protocols = &http.Protocols{}
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	case validHTTPVersion("HTTP/2.0", httpRule):
+		transport.ForceAttemptHTTP2 = true
+	}
+	proxyURL := httpRule.ParsedProxyURL
+	if proxyURL == nil {
+		return transport
+	}
+	if strings.HasPrefix(proxyURL.Scheme, "socks5") {
+		timeout := time.Second * time.Duration(r.Timeout)
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, _ := net.SplitHostPort(addr)
+			if matchNoProxy(host, port, httpRule.NoProxy) {
+				return r.dialContext(ctx, network, addr)
+			}
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return r.dialProxy(ctx, proxyURL, addr)
+		}
+		return transport
+	}
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if matchNoProxy(req.URL.Hostname(), urlPort(req.URL), httpRule.NoProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+	transport.OnProxyConnectResponse = func(ctx context.Context, proxyURL *url.URL, connectReq *http.Request, connectRes *http.Response) error {
+		if connectRes.StatusCode != http.StatusOK {
+			return connectStatusError(connectRes.Status, connectRes.StatusCode)
+		}
+		return nil
+	}
+	return transport
 }
 
-func extractValue(body []byte, httpRule *HTTPRule) (float64, error) {
-	cmd := exec.Command("jq", httpRule.PayloadExtractRule.JQQuery)
-	stdin, err := cmd.StdinPipe()
+// extractValues runs the extraction query on the body and reports one series per returned value, the series
+// of label values not returned anymore are deleted
+func extractValues(body []byte, extract *PayloadExtract, reporter MetricReporter, labels map[string]string) error {
+	results, err := extract.seriesQuery.run(body)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if len(results) == 0 {
+		return fmt.Errorf("query returned no value")
+	}
+	if len(results) > 1 && len(extract.labelNames) == 0 {
+		return fmt.Errorf("query returned %d values, labels are required to extract more than one value", len(results))
+	}
+	reported := []map[string]string{}
+	for _, result := range results {
+		series, ok := result.([]interface{})
+		if !ok || len(series) != len(extract.labelNames)+1 {
+			return fmt.Errorf("unexpected query result %v", jsonString(result))
+		}
+		seriesLabels := labels
+		for i, labelName := range extract.labelNames {
+			seriesLabels = withLabel(seriesLabels, labelName, jsonString(series[i+1]))
+		}
+		if extract.Info {
+			reporter.ReportInfo(extract.MetricName, seriesLabels, map[string]string{valueTag: jsonString(series[0])})
+			reported = append(reported, withLabel(seriesLabels, valueTag, jsonString(series[0])))
+			continue
+		}
+		val, ok := series[0].(float64)
+		if !ok {
+			return fmt.Errorf("cannot convert %v to float", jsonString(series[0]))
+		}
+		reporter.ReportValue(val, extract.MetricName, seriesLabels)
+		reported = append(reported, seriesLabels)
 	}
-	go func() {
-		defer stdin.Close()
-		io.WriteString(stdin, string(body))
-	}()
-	out, err := cmd.CombinedOutput()
+	reporter.DeleteStaleSeries(extract.MetricName, labels, reported)
+	return nil
+}
+
+// matchJSON returns one check per JSON assertion, named after its jq query
+func matchJSON(body []byte, httpRule *HTTPRule) []check {
+	checks := []check{}
+	for _, a := range httpRule.JSONAssertions {
+		err := a.match(body)
+		if err != nil {
+			log.Printf("json assertion %s failed, %v", a.JQQuery, err)
+		}
+		checks = append(checks, check{"json:" + a.JQQuery, err == nil})
+	}
+	return checks
+}
+
+// match returns an error describing the first condition of the assertion not satisfied by the body
+func (a *JSONAssertion) match(body []byte) error {
+	results, err := a.compiledQuery.run(body)
 	if err != nil {
-		fmt.Printf("error: cannot execute jq: %s\n", out)
-		return 0, err
+		return err
+	}
+	var val interface{}
+	if len(results) > 0 {
+		val = results[0]
+	}
+	if a.Exists != nil && (val != nil) != *a.Exists {
+		return fmt.Errorf("got %s, expected exists to be %t", jsonString(val), *a.Exists)
+	}
+	str := jsonString(val)
+	if a.Equals != nil && str != *a.Equals {
+		return fmt.Errorf("got %s, expected %s", str, *a.Equals)
 	}
-	outStr := fmt.Sprintf("%s", out)
-	outStr = strings.TrimSpace(outStr)
-	val, err := strconv.ParseFloat(outStr, 64)
+	if a.CompiledRegex != nil && !a.CompiledRegex.MatchString(str) {
+		return fmt.Errorf("got %s, expected to match %s", str, a.Regex)
+	}
+	if a.NumericComparison.isSet() {
+		num, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return fmt.Errorf("got %s, expected a number", str)
+		}
+		if !a.NumericComparison.match(num) {
+			return fmt.Errorf("got %s, out of bounds", str)
+		}
+	}
+	return nil
+}
+
+// jsonString returns strings as is, and other JSON values in their compact JSON form
+func jsonString(val interface{}) string {
+	if str, ok := val.(string); ok {
+		return str
+	}
+	b, err := json.Marshal(val)
 	if err != nil {
-		fmt.Printf("error: cannot convert %s to float, %v", out, err)
+		return fmt.Sprintf("%v", val)
 	}
-	return val, err
+	return string(b)
+}
+
+// needsBody returns true if the rule checks or extracts values from the response body
+func (r *HTTPRule) needsBody() bool {
+	return r.CompiledRegex != nil || len(r.BodyContentBytes) > 0 || len(r.CompiledMustMatch) > 0 || len(r.CompiledMustNotMatch) > 0 ||
+		r.keepsBody()
+}
+
+// keepsBody returns true if the rule needs the response body once it is read,
+// other body assertions are evaluated while reading it
+func (r *HTTPRule) keepsBody() bool {
+	return len(r.JSONAssertions) > 0 || len(r.PayloadExtractRules) > 0 || r.ContentHash || r.LinkCheck != nil ||
+		len(r.MetricAssertions) > 0 || len(r.MetricExports) > 0
 }
 
-func matchBody(body []byte, httpRule *HTTPRule) bool {
-	if httpRule.CompiledRegex != nil {
-		return httpRule.CompiledRegex.Match(body)
+// matchBodyRegexes returns one check per regex of body_must_match and body_must_not_match
+func matchBodyRegexes(streamed *streamedBody, httpRule *HTTPRule) []check {
+	checks := []check{}
+	for i, re := range httpRule.CompiledMustMatch {
+		checks = append(checks, check{"body_must_match:" + re.String(), streamed.mustMatch[i]})
 	}
-	if httpRule.BodyContentBytes != nil && len(httpRule.BodyContentBytes) > 0 {
-		return bytes.Equal(bytes.TrimSpace(body), httpRule.BodyContentBytes)
+	for i, re := range httpRule.CompiledMustNotMatch {
+		checks = append(checks, check{"body_must_not_match:" + re.String(), !streamed.mustNotMatch[i]})
 	}
-	return true
+	return checks
+}
+
+func validHTTPVersion(proto string, httpRule *HTTPRule) bool {
+	for _, version := range httpRule.ValidHTTPVersions {
+		if version == proto {
+			return true
+		}
+	}
+	return false
 }
 
 func validStatus(status int, httpRule *HTTPRule) bool {
@@ -118,6 +421,33 @@ func validStatus(status int, httpRule *HTTPRule) bool {
 	return status >= http.StatusOK && status < http.StatusMultipleChoices
 }
 
+// matchHeaders returns one check per header assertion, named after the assertion and the header
+func matchHeaders(header http.Header, httpRule *HTTPRule) []check {
+	checks := []check{}
+	for _, h := range httpRule.HeadersMatch {
+		values, present := header[http.CanonicalHeaderKey(h.Header)]
+		ok := !present && h.AllowMissing
+		for _, value := range values {
+			if h.CompiledRegex.MatchString(value) {
+				ok = true
+				break
+			}
+		}
+		checks = append(checks, check{"headers_match:" + h.Header, ok})
+	}
+	for _, h := range httpRule.HeadersNotMatch {
+		ok := true
+		for _, value := range header[http.CanonicalHeaderKey(h.Header)] {
+			if h.CompiledRegex.MatchString(value) {
+				ok = false
+				break
+			}
+		}
+		checks = append(checks, check{"headers_not_match:" + h.Header, ok})
+	}
+	return checks
+}
+
 func urlLabels(URL *url.URL, others map[string]string) map[string]string {
 	return pingerLabels(URL.String(), URL.Hostname(), others)
 }
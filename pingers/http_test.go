@@ -0,0 +1,328 @@
+package pingers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// redirectServer redirects /r/N to /r/N-1 and answers ok to /r/0
+func redirectServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/r/"))
+		switch {
+		case err != nil:
+			w.WriteHeader(http.StatusNotFound)
+		case n > 0:
+			http.Redirect(w, req, "/r/"+strconv.Itoa(n-1), http.StatusFound)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// probeValues runs the http pinger of httpRule on urlStr and returns the values of the Up, redirects,
+// response_code and http_version series by metric name, and of the check_failed series by check:<name>
+func probeValues(t *testing.T, urlStr string, httpRule *HTTPRule) map[string]float64 {
+	r := &Rule{Type: "http", HTTPRule: httpRule}
+	if err := r.setup(); err != nil {
+		t.Fatal(err)
+	}
+	reporter := NewReporter("", nil)
+	pingerHTTP(urlStr, reporter, r)
+	u, _ := url.Parse(urlStr)
+	labels := urlLabels(u, nil)
+	values := map[string]float64{}
+	for key, value := range collect(t, reporter) {
+		for _, name := range []string{DefaultMetricName, "redirects", "response_code", "http_version"} {
+			if key == name+labelsKey(labels) {
+				values[name] = value
+			}
+		}
+		for _, pair := range strings.Split(key, "\xff") {
+			if strings.HasPrefix(key, checkFailedMetricName) && strings.HasPrefix(pair, checkTag+"=") {
+				values["check:"+strings.TrimPrefix(pair, checkTag+"=")] = value
+			}
+		}
+	}
+	return values
+}
+
+func TestRedirects(t *testing.T) {
+	server := redirectServer(t)
+	tests := []struct {
+		name     string
+		path     string
+		httpRule *HTTPRule
+		want     map[string]float64
+	}{
+		{"no redirect", "/r/0", &HTTPRule{},
+			map[string]float64{DefaultMetricName: 1, "redirects": 0, "response_code": 200, "check:max_redirects": 0}},
+		{"redirects followed", "/r/3", &HTTPRule{},
+			map[string]float64{DefaultMetricName: 1, "redirects": 3, "response_code": 200, "check:max_redirects": 0}},
+		{"max_redirects reached", "/r/3", &HTTPRule{MaxRedirects: 3},
+			map[string]float64{DefaultMetricName: 1, "redirects": 3, "response_code": 200, "check:max_redirects": 0}},
+		// the refused redirect is not counted, the last response is the redirect
+		{"max_redirects exceeded", "/r/3", &HTTPRule{MaxRedirects: 2},
+			map[string]float64{DefaultMetricName: 0, "redirects": 2, "response_code": 302, "check:max_redirects": 1}},
+		{"default max_redirects exceeded", "/r/11", &HTTPRule{},
+			map[string]float64{DefaultMetricName: 0, "redirects": 10, "response_code": 302, "check:max_redirects": 1}},
+		{"no_follow_redirects", "/r/3", &HTTPRule{NoFollowRedirects: true, ValidHTTPStatuses: []int{302}},
+			map[string]float64{DefaultMetricName: 1, "redirects": 0, "response_code": 302, "check:max_redirects": 0}},
+		{"location_regexp", "/r/3", &HTTPRule{NoFollowRedirects: true, ValidHTTPStatuses: []int{302}, LocationRegex: "^/r/2$"},
+			map[string]float64{DefaultMetricName: 1, "check:location": 0}},
+		{"location_regexp mismatch", "/r/3", &HTTPRule{NoFollowRedirects: true, ValidHTTPStatuses: []int{302}, LocationRegex: "^https://"},
+			map[string]float64{DefaultMetricName: 0, "check:location": 1}},
+		{"location_regexp without redirect", "/r/0", &HTTPRule{LocationRegex: "."},
+			map[string]float64{DefaultMetricName: 0, "check:location": 1}},
+		{"final_url_regexp", "/r/2", &HTTPRule{FinalURLRegex: "/r/0$"},
+			map[string]float64{DefaultMetricName: 1, "redirects": 2, "check:final_url": 0}},
+		{"final_url_regexp mismatch", "/r/2", &HTTPRule{FinalURLRegex: "/login$"},
+			map[string]float64{DefaultMetricName: 0, "redirects": 2, "check:final_url": 1}},
+		{"final_url_regexp without following", "/r/2", &HTTPRule{NoFollowRedirects: true, ValidHTTPStatuses: []int{302}, FinalURLRegex: "/r/2$"},
+			map[string]float64{DefaultMetricName: 1, "check:final_url": 0}},
+	}
+	for _, test := range tests {
+		values := probeValues(t, server.URL+test.path, test.httpRule)
+		for name, want := range test.want {
+			if got, ok := values[name]; !ok || got != want {
+				t.Errorf("%s: got %v, expected %s to be %v", test.name, values, name, want)
+			}
+		}
+	}
+}
+
+func TestRedirectsConfiguration(t *testing.T) {
+	if err := (&HTTPRule{NoFollowRedirects: true, MaxRedirects: 2}).setup(); err == nil {
+		t.Errorf("no_follow_redirects with max_redirects accepted, expected an error")
+	}
+	for _, httpRule := range []*HTTPRule{{FinalURLRegex: "("}, {LocationRegex: "("}} {
+		if err := httpRule.setup(); err == nil {
+			t.Errorf("invalid regex in %+v accepted, expected an error", httpRule)
+		}
+	}
+	httpRule := &HTTPRule{}
+	if err := httpRule.setup(); err != nil || httpRule.MaxRedirects != DefaultMaxRedirects {
+		t.Errorf("got max_redirects %d, %v, expected the default %d", httpRule.MaxRedirects, err, DefaultMaxRedirects)
+	}
+}
+
+// versionServer returns the URL of a server answering ok, over TLS or cleartext, with the given protocols
+func versionServer(t *testing.T, tls bool, protocols ...string) string {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.Protocols = &http.Protocols{}
+	for _, protocol := range protocols {
+		switch protocol {
+		case "HTTP/1.1":
+			server.Config.Protocols.SetHTTP1(true)
+		case "HTTP/2.0":
+			server.Config.Protocols.SetHTTP2(true)
+			server.Config.Protocols.SetUnencryptedHTTP2(!tls)
+		}
+	}
+	if tls {
+		server.EnableHTTP2 = server.Config.Protocols.HTTP2()
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestHTTPVersions(t *testing.T) {
+	tests := []struct {
+		name     string
+		tls      bool
+		server   []string
+		httpRule *HTTPRule
+		up       float64
+		version  float64
+		checks   map[string]float64
+	}{
+		{"http/2 over tls", true, []string{"HTTP/1.1", "HTTP/2.0"}, &HTTPRule{HTTPVersion: "2"}, 1, 2,
+			map[string]float64{"check:http_version": 0}},
+		{"http/2 with prior knowledge", false, []string{"HTTP/1.1", "HTTP/2.0"}, &HTTPRule{HTTPVersion: "2"}, 1, 2,
+			map[string]float64{"check:http_version": 0}},
+		{"http/2 required over tls", true, []string{"HTTP/1.1"}, &HTTPRule{HTTPVersion: "2"}, 0, 0, nil},
+		{"http/2 required in cleartext", false, []string{"HTTP/1.1"}, &HTTPRule{HTTPVersion: "2"}, 0, 0, nil},
+		{"http/1.1 forced", true, []string{"HTTP/1.1", "HTTP/2.0"}, &HTTPRule{HTTPVersion: "1.1"}, 1, 1.1, nil},
+		{"default", true, []string{"HTTP/1.1", "HTTP/2.0"}, &HTTPRule{}, 1, 1.1, nil},
+		{"valid http/2", true, []string{"HTTP/1.1", "HTTP/2.0"}, &HTTPRule{ValidHTTPVersions: []string{"HTTP/2.0"}}, 1, 2,
+			map[string]float64{"check:valid_http_versions": 0}},
+		{"invalid http/1.1", true, []string{"HTTP/1.1"}, &HTTPRule{ValidHTTPVersions: []string{"HTTP/2.0"}}, 0, 1.1,
+			map[string]float64{"check:valid_http_versions": 1}},
+		{"valid http/1.1", false, []string{"HTTP/1.1"}, &HTTPRule{ValidHTTPVersions: []string{"HTTP/1.0", "HTTP/1.1"}}, 1, 1.1,
+			map[string]float64{"check:valid_http_versions": 0}},
+	}
+	for _, test := range tests {
+		test.httpRule.Insecure = true
+		values := probeValues(t, versionServer(t, test.tls, test.server...), test.httpRule)
+		if values[DefaultMetricName] != test.up || values["http_version"] != test.version {
+			t.Errorf("%s: got %v, expected up %v and http_version %v", test.name, values, test.up, test.version)
+		}
+		for name, want := range test.checks {
+			if got, ok := values[name]; !ok || got != want {
+				t.Errorf("%s: got %v, expected %s to be %v", test.name, values, name, want)
+			}
+		}
+	}
+}
+
+func TestHTTPVersionsConfiguration(t *testing.T) {
+	for _, httpRule := range []*HTTPRule{{HTTPVersion: "3"}, {HTTPVersion: "2.0"}, {ValidHTTPVersions: []string{"2"}}, {ValidHTTPVersions: []string{"http/1.1"}}} {
+		if err := httpRule.setup(); err == nil {
+			t.Errorf("%+v accepted, expected an error", httpRule)
+		}
+	}
+	for _, httpRule := range []*HTTPRule{{HTTPVersion: "1.1"}, {HTTPVersion: "2"}, {ValidHTTPVersions: []string{"HTTP/1.0", "HTTP/2.0"}}} {
+		if err := httpRule.setup(); err != nil {
+			t.Errorf("%+v rejected, %v", httpRule, err)
+		}
+	}
+}
+
+func TestExtractValuesDeletesStaleSeries(t *testing.T) {
+	for _, info := range []bool{false, true} {
+		extract := &PayloadExtract{MetricName: "queue_depth", JQQuery: ".[]", ValueQuery: ".depth", Labels: map[string]string{"queue": ".name"}, Info: info}
+		if err := extract.setup(); err != nil {
+			t.Fatal(err)
+		}
+		r := NewReporter("", nil)
+		labels := pingerLabels("http://a/", "a", nil)
+		other := pingerLabels("http://b/", "b", nil)
+		if err := extractValues([]byte(`[{"name": "mail", "depth": 3}, {"name": "jobs", "depth": 5}]`), extract, r, labels); err != nil {
+			t.Fatal(err)
+		}
+		if err := extractValues([]byte(`[{"name": "mail", "depth": 4}]`), extract, r, other); err != nil {
+			t.Fatal(err)
+		}
+		if err := extractValues([]byte(`[{"name": "mail", "depth": 4}]`), extract, r, labels); err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for key := range collect(t, r) {
+			if strings.Contains(key, "queue=jobs") {
+				t.Errorf("info %v: got series %s, expected the queue jobs to be deleted", info, key)
+			}
+			if strings.Contains(key, "queue=mail") {
+				n++
+			}
+		}
+		if n != 2 {
+			t.Errorf("info %v: got %d series of the queue mail, expected one per target", info, n)
+		}
+	}
+}
+
+func TestJSONAssertionMatch(t *testing.T) {
+	body := []byte(`{"status": "ok", "version": "1.12.3", "workers": 4, "load": 0.75, "ready": false, "errors": 0,
+		"empty": "", "nothing": null, "items": [{"id": 1}, {"id": 2}]}`)
+	str := func(s string) *string { return &s }
+	boolean := func(b bool) *bool { return &b }
+	float := func(f float64) *float64 { return &f }
+	tests := []struct {
+		name      string
+		assertion JSONAssertion
+		ok        bool
+	}{
+		{"equal string", JSONAssertion{JQQuery: ".status", Equals: str("ok")}, true},
+		{"different string", JSONAssertion{JQQuery: ".status", Equals: str("degraded")}, false},
+		{"equal number", JSONAssertion{JQQuery: ".workers", Equals: str("4")}, true},
+		{"equal false", JSONAssertion{JQQuery: ".ready", Equals: str("false")}, true},
+		{"equal array", JSONAssertion{JQQuery: "[.items[].id]", Equals: str("[1,2]")}, true},
+		{"equal missing", JSONAssertion{JQQuery: ".missing", Equals: str("null")}, true},
+		{"matching regex", JSONAssertion{JQQuery: ".version", Regex: `^1\.1[0-9]\.`}, true},
+		{"not matching regex", JSONAssertion{JQQuery: ".version", Regex: `^2\.`}, false},
+		{"regex on a number", JSONAssertion{JQQuery: ".load", Regex: `^0\.7`}, true},
+		{"in bounds", JSONAssertion{JQQuery: ".workers", NumericComparison: NumericComparison{GreaterThan: float(2), LessOrEqual: float(4)}}, true},
+		{"out of bounds", JSONAssertion{JQQuery: ".load", NumericComparison: NumericComparison{LessThan: float(0.5)}}, false},
+		{"numeric string", JSONAssertion{JQQuery: ".version | split(\".\")[1]", NumericComparison: NumericComparison{GreaterOrEqual: float(12)}}, true},
+		{"not a number", JSONAssertion{JQQuery: ".status", NumericComparison: NumericComparison{GreaterThan: float(0)}}, false},
+		{"existing", JSONAssertion{JQQuery: ".status", Exists: boolean(true)}, true},
+		{"existing false", JSONAssertion{JQQuery: ".ready", Exists: boolean(true)}, true},
+		{"existing 0", JSONAssertion{JQQuery: ".errors", Exists: boolean(true)}, true},
+		{"existing empty string", JSONAssertion{JQQuery: ".empty", Exists: boolean(true)}, true},
+		{"missing", JSONAssertion{JQQuery: ".missing", Exists: boolean(true)}, false},
+		{"missing nested", JSONAssertion{JQQuery: ".items[5].id", Exists: boolean(true)}, false},
+		{"null", JSONAssertion{JQQuery: ".nothing", Exists: boolean(true)}, false},
+		{"expected missing", JSONAssertion{JQQuery: ".missing", Exists: boolean(false)}, true},
+		{"expected missing false", JSONAssertion{JQQuery: ".ready", Exists: boolean(false)}, false},
+		{"no result", JSONAssertion{JQQuery: ".items[] | select(.id > 2)", Exists: boolean(true)}, false},
+		{"query error", JSONAssertion{JQQuery: ".status.id"}, false},
+	}
+	for _, test := range tests {
+		if err := test.assertion.setup(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		err := test.assertion.match(body)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, expected success %t", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestMatchHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Add("Cache-Control", "no-store")
+	header.Add("Set-Cookie", "theme=dark")
+	header.Add("Set-Cookie", "session=1234; Secure; HttpOnly")
+	tests := []struct {
+		name     string
+		match    []*HeaderMatch
+		notMatch []*HeaderMatch
+		want     []check
+	}{
+		{"matching header", []*HeaderMatch{{Header: "content-type", Regex: "^application/json"}}, nil,
+			[]check{{"headers_match:content-type", true}}},
+		{"not matching header", []*HeaderMatch{{Header: "Content-Type", Regex: "^text/"}}, nil,
+			[]check{{"headers_match:Content-Type", false}}},
+		{"missing header", []*HeaderMatch{{Header: "X-Request-Id", Regex: ".*"}}, nil,
+			[]check{{"headers_match:X-Request-Id", false}}},
+		{"allowed missing header", []*HeaderMatch{{Header: "X-Request-Id", Regex: "^[0-9a-f]+$", AllowMissing: true}}, nil,
+			[]check{{"headers_match:X-Request-Id", true}}},
+		{"allowed missing header present", []*HeaderMatch{{Header: "Cache-Control", Regex: "max-age", AllowMissing: true}}, nil,
+			[]check{{"headers_match:Cache-Control", false}}},
+		{"repeated header with a matching value", []*HeaderMatch{{Header: "Set-Cookie", Regex: "^session=.*Secure"}}, nil,
+			[]check{{"headers_match:Set-Cookie", true}}},
+		{"repeated header without a matching value", []*HeaderMatch{{Header: "Set-Cookie", Regex: "SameSite"}}, nil,
+			[]check{{"headers_match:Set-Cookie", false}}},
+		{"header not matching", nil, []*HeaderMatch{{Header: "Cache-Control", Regex: "public"}},
+			[]check{{"headers_not_match:Cache-Control", true}}},
+		{"header matching", nil, []*HeaderMatch{{Header: "Cache-Control", Regex: "no-store"}},
+			[]check{{"headers_not_match:Cache-Control", false}}},
+		{"missing header not matching", nil, []*HeaderMatch{{Header: "Server", Regex: ".*"}},
+			[]check{{"headers_not_match:Server", true}}},
+		{"repeated header with a value matching", nil, []*HeaderMatch{{Header: "Set-Cookie", Regex: "^theme="}},
+			[]check{{"headers_not_match:Set-Cookie", false}}},
+		{"both lists", []*HeaderMatch{{Header: "Content-Type", Regex: "json"}}, []*HeaderMatch{{Header: "Set-Cookie", Regex: "Secure"}},
+			[]check{{"headers_match:Content-Type", true}, {"headers_not_match:Set-Cookie", false}}},
+	}
+	for _, test := range tests {
+		httpRule := &HTTPRule{HeadersMatch: test.match, HeadersNotMatch: test.notMatch}
+		for _, h := range append(append([]*HeaderMatch{}, test.match...), test.notMatch...) {
+			if err := h.setup(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := matchHeaders(header, httpRule)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %v, expected %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package pingers
 
 import (
+	"context"
 	"log"
 	"os/exec"
 	"strconv"
@@ -9,13 +10,30 @@ import (
 
 func pingerICMP(addr string, reporter MetricReporter, c *Rule) error {
 	start := time.Now()
-	err := exec.Command("ping", "-n", "-c", "1", "-W", strconv.Itoa(c.Timeout), addr).Run()
+	args := []string{"-n", "-c", "1", "-W", strconv.Itoa(c.Timeout)}
+	ipVer := 0
+	host := addr
+	if c.PreferredIPProtocol != "" || c.targetIP != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(c.Timeout))
+		ip, err := c.resolveIP(ctx, addr)
+		cancel()
+		if err != nil {
+			log.Printf("Couldn't resolve %s: %v\n", addr, err)
+			reporter.ReportSuccess(false, c.MetricName, hostLabel(addr, c.tags))
+			return err
+		}
+		ipVer = ipVersion(ip)
+		args = append(args, "-"+strconv.Itoa(ipVer))
+		host = ip.String()
+	}
+	err := exec.Command("ping", append(args, host)...).Run()
 	if err != nil {
 		log.Printf("Couldn't ping %s: %v\n", addr, err)
 		reporter.ReportSuccess(false, c.MetricName, hostLabel(addr, c.tags))
 		return err
 	}
 	reporter.ReportLatency(time.Since(start).Seconds(), hostLabel(addr, c.tags))
+	reportIPProtocol(ipVer, reporter, hostLabel(addr, c.tags))
 	reporter.ReportSuccess(true, c.MetricName, hostLabel(addr, c.tags))
 	return nil
 }
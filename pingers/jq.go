@@ -0,0 +1,130 @@
+package pingers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/itchyny/gojq"
+)
+
+// jqMaxDuration bounds the time spent running a jq query on a response, like an unbounded range
+const jqMaxDuration = time.Second
+
+// jqQuery is a compiled jq query, evaluated in-process with gojq
+type jqQuery struct {
+	query string
+	code  *gojq.Code
+}
+
+// compileJQ parses and compiles query, returning an error if it is not valid
+func compileJQ(query string) (*jqQuery, error) {
+	parsed, err := gojq.Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse jq query %s, %v", query, err)
+	}
+	code, err := gojq.Compile(parsed, gojq.WithFunction("keys_unsorted", 0, 0, jqKeysUnsorted))
+	if err != nil {
+		return nil, fmt.Errorf("cannot compile jq query %s, %v", query, err)
+	}
+	return &jqQuery{query: query, code: code}, nil
+}
+
+// run evaluates the query on each JSON document of input and returns all the results.
+// Numbers of the results are float64, like the values decoded by encoding/json.
+func (q *jqQuery) run(input []byte) ([]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jqMaxDuration)
+	defer cancel()
+	results := []interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(input))
+	decoder.UseNumber()
+	for {
+		var doc interface{}
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode JSON input, %v", err)
+		}
+		iter := q.code.RunWithContext(ctx, doc)
+		for {
+			val, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if err, ok := val.(error); ok {
+				return nil, fmt.Errorf("cannot run jq query %s, %v", q.query, err)
+			}
+			results = append(results, jqFloats(val))
+		}
+	}
+}
+
+// jqKeysUnsorted implements keys_unsorted, missing from gojq because its objects are not ordered.
+// Like the iteration of objects, it returns the keys in sorted order.
+func jqKeysUnsorted(val interface{}, _ []interface{}) interface{} {
+	if arr, ok := val.([]interface{}); ok {
+		indexes := make([]interface{}, len(arr))
+		for i := range arr {
+			indexes[i] = i
+		}
+		return indexes
+	}
+	obj, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("keys_unsorted cannot be applied to: %s", jsonString(val))
+	}
+	keys := make([]interface{}, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].(string) < keys[j].(string) })
+	return keys
+}
+
+// jqFloats returns a copy of a gojq value with float64 numbers, the value itself is not modified
+// because it can be a constant of the compiled query
+func jqFloats(val interface{}) interface{} {
+	switch v := val.(type) {
+	case int:
+		return float64(v)
+	case float64:
+		// like jq, infinities are the largest numbers and NaN is null
+		switch {
+		case math.IsNaN(v):
+			return nil
+		case math.IsInf(v, 1):
+			return math.MaxFloat64
+		case math.IsInf(v, -1):
+			return -math.MaxFloat64
+		}
+		return v
+	case json.Number:
+		f, _ := strconv.ParseFloat(v.String(), 64)
+		return f
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(v).Float64()
+		return f
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = jqFloats(item)
+		}
+		return items
+	case map[string]interface{}:
+		items := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			items[key] = jqFloats(item)
+		}
+		return items
+	}
+	return val
+}
@@ -0,0 +1,112 @@
+package pingers
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// the expected results are the output of jq 1.7 for the same input and query.
+// Object keys are iterated in sorted order, unlike jq, so the inputs have sorted keys.
+func TestJQRun(t *testing.T) {
+	tests := []struct {
+		input string
+		query string
+		want  string // results, as a JSON array
+	}{
+		{`{"a":1,"b":[1,2,3]}`, `.a`, `[1]`},
+		{`{"a":1,"b":[1,2,3]}`, `.b | length`, `[3]`},
+		{`{"a":1,"b":[1,2,3]}`, `.b[]`, `[1,2,3]`},
+		{`{"a":1,"b":[1,2,3]}`, `reduce .b[] as $x (0; . + $x)`, `[6]`},
+		{`{"a":"x"}`, `try (.a | tonumber) catch "bad"`, `["bad"]`},
+		{`{"a":"Foo"}`, `.a | test("foo"; "i")`, `[true]`},
+		{`[{"k":"a","v":1},{"k":"b","v":2},{"k":"a","v":3}]`, `group_by(.k) | map({k: .[0].k, total: map(.v) | add})`, `[[{"k":"a","total":4},{"k":"b","total":2}]]`},
+		{`"a,b,c"`, `index(",")`, `[1]`},
+		{`{"a":{"b":1},"c":[2]}`, `[paths]`, `[[["a"],["a","b"],["c"],["c",0]]]`},
+		{`{"a":1,"b":2}`, `del(.a)`, `[{"b":2}]`},
+		{`{"a":1,"b":2}`, `keys_unsorted`, `[["a","b"]]`},
+		{`[5,6]`, `keys_unsorted`, `[[0,1]]`},
+		{`{"a":1,"b":2}`, `.a |= . + 10`, `[{"a":11,"b":2}]`},
+		{`"hello"`, `@base64`, `["aGVsbG8="]`},
+		{`null`, `1e1000`, `[1.7976931348623157e+308]`},
+		{`{"a":1,"b":2}`, `to_entries`, `[[{"key":"a","value":1},{"key":"b","value":2}]]`},
+		{`{"a":1,"b":2}`, `.[]`, `[1,2]`},
+		{`{"items":[{"n":"x","ok":true},{"n":"y","ok":false}]}`, `[.items[] | select(.ok) | .n]`, `[["x"]]`},
+		{`{"v":"1.2.3"}`, `.v | split(".") | map(tonumber)`, `[[1,2,3]]`},
+		{`[3,1,2]`, `sort, max, min`, `[[1,2,3],3,1]`},
+		{`{"a":null}`, `.a // "default"`, `["default"]`},
+		{`{"n":12345678901234567890}`, `.n`, `[12345678901234567000]`},
+		{`[1,2,3]`, `map(. * 2) | add`, `[12]`},
+		{`{"a":[1,2]}`, `if (.a | length) > 1 then "many" elif .a then "one" else "none" end`, `["many"]`},
+		{`[1,[2,[3]]]`, `flatten`, `[[1,2,3]]`},
+		{`"2015-03-05T23:51:47Z"`, `fromdateiso8601`, `[1425599507]`},
+		{`{"a":"b"}`, `with_entries(.value |= ascii_upcase)`, `[{"a":"B"}]`},
+		{`1 2`, `. + 1`, `[2,3]`},
+	}
+	for _, test := range tests {
+		q, err := compileJQ(test.query)
+		if err != nil {
+			t.Errorf("compileJQ(%s) failed, %v", test.query, err)
+			continue
+		}
+		got, err := q.run([]byte(test.input))
+		if err != nil {
+			t.Errorf("%s on %s failed, %v", test.query, test.input, err)
+			continue
+		}
+		var want []interface{}
+		if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s on %s returned %s, expected %s", test.query, test.input, jsonString(got), test.want)
+		}
+	}
+}
+
+func TestJQErrors(t *testing.T) {
+	for _, query := range []string{`.a |`, `unknown_function`, `.[`} {
+		if _, err := compileJQ(query); err == nil {
+			t.Errorf("compileJQ(%s) succeeded, expected an error", query)
+		}
+	}
+	q, err := compileJQ(`.a | tonumber`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.run([]byte(`{"a":"x"}`)); err == nil {
+		t.Errorf("tonumber of x succeeded, expected an error")
+	}
+	if _, err := q.run([]byte(`{"a":`)); err == nil {
+		t.Errorf("query on invalid JSON succeeded, expected an error")
+	}
+}
+
+func TestJQMaxDuration(t *testing.T) {
+	q, err := compileJQ(`[range(1e15)] | length`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := q.run([]byte(`null`)); err == nil {
+		t.Errorf("unbounded range succeeded, expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*jqMaxDuration {
+		t.Errorf("unbounded range ran for %v, expected at most %v", elapsed, jqMaxDuration)
+	}
+}
+
+// the results must not share the constants of the compiled query
+func TestJQResultsAreCopies(t *testing.T) {
+	q, err := compileJQ(`[1, {"a": 2}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := q.run([]byte(`null`))
+	first[0].([]interface{})[0] = "changed"
+	second, _ := q.run([]byte(`null`))
+	if second[0].([]interface{})[0] != 1.0 {
+		t.Errorf("got %s, expected the results of the query to be independent", jsonString(second))
+	}
+}
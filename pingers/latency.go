@@ -0,0 +1,44 @@
+package pingers
+
+// status metric values, reported for rules with a degraded latency
+const (
+	statusDown     = 0
+	statusDegraded = 1
+	statusUp       = 2
+)
+
+// latencyReporter applies the latency thresholds of a rule to the success of a probe. A successful probe
+// taking more than the max latency fails, the status metric tells if it took more than the degraded latency.
+type latencyReporter struct {
+	MetricReporter
+	rule     *Rule
+	latency  float64
+	measured bool
+}
+
+func (r *latencyReporter) ReportLatency(latency float64, labels map[string]string) {
+	r.latency = latency
+	r.measured = true
+	r.MetricReporter.ReportLatency(latency, labels)
+}
+
+func (r *latencyReporter) ReportSuccess(success bool, metricName string, labels map[string]string) {
+	if metricName != r.rule.MetricName {
+		r.MetricReporter.ReportSuccess(success, metricName, labels)
+		return
+	}
+	if success && r.measured && r.rule.MaxLatency > 0 {
+		success = reportChecks([]check{{"max_latency", r.latency <= r.rule.MaxLatency}}, labels[urlTag], r.MetricReporter, labels)
+	}
+	if r.rule.DegradedLatency > 0 {
+		status := statusDown
+		if success {
+			status = statusUp
+			if r.measured && r.latency > r.rule.DegradedLatency {
+				status = statusDegraded
+			}
+		}
+		r.MetricReporter.ReportValue(float64(status), "status", labels)
+	}
+	r.MetricReporter.ReportSuccess(success, metricName, labels)
+}
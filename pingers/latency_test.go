@@ -0,0 +1,150 @@
+package pingers
+
+import "testing"
+
+// fakeReporter records the last value reported for each series, by metric name and label values
+type fakeReporter struct {
+	values map[string]float64
+}
+
+func newFakeReporter() *fakeReporter {
+	return &fakeReporter{values: map[string]float64{}}
+}
+
+func (r *fakeReporter) ReportLatency(latency float64, labels map[string]string) {
+	r.ReportValue(latency, "latency_seconds", labels)
+}
+
+func (r *fakeReporter) ReportSize(size int, labels map[string]string) {
+	r.ReportValue(float64(size), "size_bytes", labels)
+}
+
+func (r *fakeReporter) ReportHttpStatus(status int, labels map[string]string) {
+	r.ReportValue(float64(status), "response_code", labels)
+}
+
+func (r *fakeReporter) ReportSuccess(success bool, metricName string, labels map[string]string) {
+	value := 0.0
+	if success {
+		value = 1
+	}
+	r.ReportValue(value, metricName, labels)
+}
+
+func (r *fakeReporter) ReportValue(val float64, metricName string, labels map[string]string) {
+	r.values[metricName+labelsKey(labels)] = val
+}
+
+func (r *fakeReporter) ReportInfo(metricName string, labels map[string]string, info map[string]string) {
+	for key, val := range info {
+		labels = withLabel(labels, key, val)
+	}
+	r.ReportValue(1, metricName, labels)
+}
+
+func (r *fakeReporter) DeleteSeries(labels map[string]string) {}
+
+func (r *fakeReporter) DeleteStaleSeries(metricName string, labels map[string]string, current []map[string]string) {
+}
+
+func TestLatencyReporter(t *testing.T) {
+	labels := pingerLabels("http://a/", "a", nil)
+	key := func(name string) string {
+		return name + labelsKey(labels)
+	}
+	maxLatencyKey := checkFailedMetricName + labelsKey(withLabel(labels, checkTag, "max_latency"))
+	tests := []struct {
+		name     string
+		rule     *Rule
+		latency  float64 // reported before the success if not negative
+		success  bool
+		want     map[string]float64
+		notFound []string
+	}{
+		{"up", &Rule{MetricName: DefaultMetricName, DegradedLatency: 1}, 0.5, true,
+			map[string]float64{key("status"): statusUp, key(DefaultMetricName): 1}, []string{maxLatencyKey}},
+		{"degraded", &Rule{MetricName: DefaultMetricName, DegradedLatency: 1}, 1.5, true,
+			map[string]float64{key("status"): statusDegraded, key(DefaultMetricName): 1}, nil},
+		{"down", &Rule{MetricName: DefaultMetricName, DegradedLatency: 1}, 0.5, false,
+			map[string]float64{key("status"): statusDown, key(DefaultMetricName): 0}, nil},
+		{"down without latency", &Rule{MetricName: DefaultMetricName, DegradedLatency: 1}, -1, false,
+			map[string]float64{key("status"): statusDown, key(DefaultMetricName): 0}, nil},
+		{"up without latency", &Rule{MetricName: DefaultMetricName, DegradedLatency: 1}, -1, true,
+			map[string]float64{key("status"): statusUp, key(DefaultMetricName): 1}, nil},
+		{"below max latency", &Rule{MetricName: DefaultMetricName, MaxLatency: 1}, 0.5, true,
+			map[string]float64{maxLatencyKey: 0, key(DefaultMetricName): 1}, []string{key("status")}},
+		{"above max latency", &Rule{MetricName: DefaultMetricName, MaxLatency: 1, DegradedLatency: 0.5}, 1.5, true,
+			map[string]float64{maxLatencyKey: 1, key("status"): statusDown, key(DefaultMetricName): 0}, nil},
+		{"failed probe above max latency", &Rule{MetricName: DefaultMetricName, MaxLatency: 1}, 1.5, false,
+			map[string]float64{key(DefaultMetricName): 0}, []string{maxLatencyKey}},
+	}
+	for _, test := range tests {
+		fake := newFakeReporter()
+		r := &latencyReporter{MetricReporter: fake, rule: test.rule}
+		if test.latency >= 0 {
+			r.ReportLatency(test.latency, labels)
+		}
+		r.ReportSuccess(test.success, DefaultMetricName, labels)
+		for k, v := range test.want {
+			if got, ok := fake.values[k]; !ok || got != v {
+				t.Errorf("%s: got %v, expected %s to be %v", test.name, fake.values, k, v)
+			}
+		}
+		for _, k := range test.notFound {
+			if _, ok := fake.values[k]; ok {
+				t.Errorf("%s: got %v, expected no %s", test.name, fake.values, k)
+			}
+		}
+	}
+}
+
+func TestLatencyReporterIgnoresOtherMetrics(t *testing.T) {
+	labels := pingerLabels("http://a/", "a", nil)
+	rule := &Rule{MetricName: DefaultMetricName, MaxLatency: 1, DegradedLatency: 0.5}
+	fake := newFakeReporter()
+	r := &latencyReporter{MetricReporter: fake, rule: rule}
+	r.ReportLatency(2, labels)
+	r.ReportSuccess(true, "links_ok", labels)
+	if got := fake.values["links_ok"+labelsKey(labels)]; got != 1 {
+		t.Errorf("got %v, expected links_ok to be reported unchanged", fake.values)
+	}
+	if len(fake.values) != 2 {
+		t.Errorf("got %v, expected only the latency and links_ok", fake.values)
+	}
+}
+
+func TestLatencyReporterInLabeledReporter(t *testing.T) {
+	labels := pingerLabels("http://a/", "a", nil)
+	ipLabels := withLabel(labels, ipTag, "10.0.0.1")
+	rule := &Rule{MetricName: DefaultMetricName, MaxLatency: 1, DegradedLatency: 0.5}
+	fake := newFakeReporter()
+	ipReporter := newLabeledReporter(fake, ipMetricPrefix, ipTag, "10.0.0.1", rule.MetricName)
+	r := &latencyReporter{MetricReporter: ipReporter, rule: rule}
+	r.ReportLatency(0.7, labels)
+	r.ReportSuccess(true, rule.MetricName, labels)
+	want := map[string]float64{
+		ipMetricPrefix + "latency_seconds" + labelsKey(ipLabels):                                         0.7,
+		ipMetricPrefix + "status" + labelsKey(ipLabels):                                                  statusDegraded,
+		ipMetricPrefix + checkFailedMetricName + labelsKey(withLabel(ipLabels, checkTag, "max_latency")): 0,
+		ipMetricPrefix + DefaultMetricName + labelsKey(ipLabels):                                         1,
+	}
+	if len(fake.values) != len(want) {
+		t.Errorf("got %v, expected %v", fake.values, want)
+	}
+	for k, v := range want {
+		if got, ok := fake.values[k]; !ok || got != v {
+			t.Errorf("got %v, expected %s to be %v", fake.values, k, v)
+		}
+	}
+	if !ipReporter.healthy {
+		t.Errorf("got an unhealthy address, expected the success to be recorded")
+	}
+
+	// an address above the max latency is not healthy
+	r = &latencyReporter{MetricReporter: ipReporter, rule: rule}
+	r.ReportLatency(1.5, labels)
+	r.ReportSuccess(true, rule.MetricName, labels)
+	if ipReporter.healthy {
+		t.Errorf("got a healthy address, expected it to fail above the max latency")
+	}
+}
@@ -0,0 +1,177 @@
+package pingers
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const slowestLinkMetricName = "link_slowest" + infoSuffix
+const linkTag = "link"
+
+// linkAttributes is the attribute holding the URL of each tag whose links are checked
+var linkAttributes = map[string]string{"a": "href", "script": "src", "link": "href", "img": "src"}
+
+// assetLinkRels are the rel values of link tags referencing resources of the page,
+// other link tags like canonical or preconnect are not checked
+var assetLinkRels = []string{"stylesheet", "icon", "preload", "modulepreload", "manifest"}
+
+// link is a URL referenced by an HTML page
+type link struct {
+	tag string
+	url *url.URL
+}
+
+// linkResult is the outcome of fetching a link
+type linkResult struct {
+	link
+	ok      bool
+	latency time.Duration
+}
+
+// pageLinks returns the same origin links of the HTML page at pageURL, in the order of the page,
+// without duplicates and with at most linkCheck.MaxLinks links
+func pageLinks(body []byte, pageURL *url.URL, linkCheck *LinkCheck) []link {
+	links := []link{}
+	seen := map[string]bool{}
+	base := pageURL
+	for _, tag := range htmlTags(body) {
+		if tag.name == "base" {
+			if href, err := pageURL.Parse(tag.attrs["href"]); err == nil && tag.attrs["href"] != "" {
+				base = href
+			}
+			continue
+		}
+		attr, ok := linkAttributes[tag.name]
+		if !ok || !linkCheck.checksTag(tag.name) {
+			continue
+		}
+		ref := strings.TrimSpace(tag.attrs[attr])
+		if ref == "" || (tag.name == "link" && !isAssetLink(tag.attrs["rel"])) {
+			continue
+		}
+		u, err := base.Parse(ref)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		u.Fragment = ""
+		if u.Scheme != pageURL.Scheme || u.Host != pageURL.Host || seen[u.String()] {
+			continue
+		}
+		seen[u.String()] = true
+		links = append(links, link{tag: tag.name, url: u})
+		if len(links) >= linkCheck.MaxLinks {
+			break
+		}
+	}
+	return links
+}
+
+func isAssetLink(rel string) bool {
+	for _, value := range strings.Fields(strings.ToLower(rel)) {
+		for _, assetRel := range assetLinkRels {
+			if value == assetRel {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *LinkCheck) checksTag(tag string) bool {
+	for _, t := range c.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *LinkCheck) isCritical(tag string) bool {
+	for _, t := range c.CriticalTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLinks fetches concurrently the same origin links of the HTML page and reports the number of links,
+// of broken ones and the slowest link. It returns false if a critical link is broken.
+// All the links are fetched before deadline, the one of the probe, the links not fetched by then are broken.
+func checkLinks(body []byte, pageURL *url.URL, deadline time.Time, reporter MetricReporter,
+	labels map[string]string, r *Rule) bool {
+
+	linkCheck := r.HTTPRule.LinkCheck
+	links := pageLinks(body, pageURL, linkCheck)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	transport := newHTTPTransport(r)
+	transport.DisableKeepAlives = false
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	results := make([]linkResult, len(links))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < linkCheck.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = fetchLink(ctx, client, links[i], r.HTTPRule.ReadMax)
+			}
+		}()
+	}
+	for i := range links {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	broken := 0
+	criticalBroken := 0
+	var slowest *linkResult
+	for i, result := range results {
+		if !result.ok {
+			log.Printf("broken %s link %s in %s", result.tag, result.url, pageURL)
+			broken++
+			if linkCheck.isCritical(result.tag) {
+				criticalBroken++
+			}
+		}
+		if slowest == nil || result.latency > slowest.latency {
+			slowest = &results[i]
+		}
+	}
+	reporter.ReportValue(float64(len(results)), "links_total", labels)
+	reporter.ReportValue(float64(broken), "links_broken", labels)
+	reporter.ReportValue(float64(criticalBroken), "links_critical_broken", labels)
+	if slowest != nil {
+		reporter.ReportValue(slowest.latency.Seconds(), "link_slowest_seconds", labels)
+		reporter.ReportInfo(slowestLinkMetricName, labels, map[string]string{linkTag: slowest.url.String()})
+	}
+	return criticalBroken == 0
+}
+
+// fetchLink gets the link and reads its body, the link is broken if this fails or its status is 400 or more
+func fetchLink(ctx context.Context, client *http.Client, l link, readMax int64) linkResult {
+	start := time.Now()
+	req, err := http.NewRequest(http.MethodGet, l.url.String(), nil)
+	if err != nil {
+		return linkResult{link: l}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return linkResult{link: l, latency: time.Since(start)}
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, readMax))
+	return linkResult{link: l, ok: err == nil && resp.StatusCode < 400, latency: time.Since(start)}
+}
@@ -0,0 +1,37 @@
+package pingers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// the links share the deadline of the probe, slow links fetched after it are broken
+func TestCheckLinksDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	pageURL, _ := url.Parse(server.URL + "/")
+	r := &Rule{MetricName: "links", Timeout: 1, HTTPRule: &HTTPRule{
+		ReadMax:   1024,
+		LinkCheck: &LinkCheck{Tags: []string{"a"}, MaxLinks: 10, Concurrency: 1},
+	}}
+	body := []byte(`<a href="/fast"><a href="/slow"><a href="/slow?1"><a href="/slow?2"><a href="/fast?1">`)
+	labels := pingerLabels(pageURL.String(), "links", nil)
+
+	reporter := NewReporter("", nil)
+	start := time.Now()
+	checkLinks(body, pageURL, start.Add(500*time.Millisecond), reporter, labels, r)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("links checked in %v, expected the deadline of the probe to stop them", elapsed)
+	}
+	values := collect(t, reporter)
+	if values["links_total"+labelsKey(labels)] != 5 || values["links_broken"+labelsKey(labels)] != 3 {
+		t.Errorf("got %v, expected 5 links with the 3 last ones broken by the deadline", values)
+	}
+}
@@ -1,8 +1,10 @@
 package pingers
 
 import (
+	"context"
 	"database/sql"
 	"log"
+	"net"
 	"strings"
 	"time"
 
@@ -10,11 +12,17 @@ import (
 	"github.com/go-sql-driver/mysql"
 )
 
-//pingerMysql requires a connStr as username:password@protocol(hostname:port)/database
+// pingerMysql requires a connStr as username:password@protocol(hostname:port)/database
 func pingerMysql(connStr string, reporter MetricReporter, c *Rule) error {
 	start := time.Now()
 
-	conn, err := sql.Open("mysql", connStr)
+	dsn, err := mysqlDSN(connStr, c)
+	if err != nil {
+		log.Printf("ERROR: cannot parse MySQL connection string: %v\n", err)
+		reporter.ReportSuccess(false, c.MetricName, mysqlLabels(connStr, c.tags))
+		return err
+	}
+	conn, err := sql.Open("mysql", dsn)
 	if err != nil {
 		log.Printf("ERROR: cannot open connection to DB %v\n", err)
 		reporter.ReportSuccess(false, c.MetricName, mysqlLabels(connStr, c.tags))
@@ -38,10 +46,46 @@ func pingerMysql(connStr string, reporter MetricReporter, c *Rule) error {
 	}
 
 	reporter.ReportLatency(time.Since(start).Seconds(), mysqlLabels(connStr, c.tags))
+	if c.mysqlIPProtocols != nil {
+		if connConf, err := mysql.ParseDSN(connStr); err == nil {
+			if version, ok := c.mysqlIPProtocols.Load(connConf.Addr); ok {
+				reportIPProtocol(version.(int), reporter, mysqlLabels(connStr, c.tags))
+			}
+		}
+	}
 	reporter.ReportSuccess(success, c.MetricName, mysqlLabels(connStr, c.tags))
 	return nil
 }
 
+// mysqlDSN returns the connection string to use, TCP connections are made with the dial function
+// of the rule when it has a preferred IP protocol
+func mysqlDSN(connStr string, c *Rule) (string, error) {
+	if c.mysqlNet == "" {
+		return connStr, nil
+	}
+	connConf, err := mysql.ParseDSN(connStr)
+	if err != nil {
+		return "", err
+	}
+	if connConf.Net != "tcp" {
+		return connStr, nil
+	}
+	connConf.Net = c.mysqlNet
+	return connConf.FormatDSN(), nil
+}
+
+// dialMysql is the mysql dial function of rules with a preferred IP protocol
+func (r *Rule) dialMysql(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(r.Timeout))
+	defer cancel()
+	conn, err := r.dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r.mysqlIPProtocols.Store(addr, ipProtocol(conn.RemoteAddr()))
+	return conn, nil
+}
+
 func mysqlLabels(connStr string, others map[string]string) map[string]string {
 	// TODO
 	connConf, err := mysql.ParseDSN(connStr)
@@ -30,16 +30,36 @@ func readSize(r io.Reader) (int, error) {
 // Ping executes the matching pinger function for the url.
 // If no pinger function can be found, it return ErrUnsupportedScheme.
 func Ping(target *Target, reporter MetricReporter) error {
-	switch target.Rule.Type {
+	if target.Rule.ProbeAllIPs {
+		return pingAllIPs(target, reporter)
+	}
+	return ping(target.Addr, reporter, target.Rule)
+}
+
+func ping(addr string, reporter MetricReporter, rule *Rule) error {
+	if rule.MaxLatency > 0 || rule.DegradedLatency > 0 {
+		reporter = &latencyReporter{MetricReporter: reporter, rule: rule}
+	}
+	switch rule.Type {
 	case "http":
-		return pingerHTTP(target.Addr, reporter, target.Rule)
+		return pingerHTTP(addr, reporter, rule)
 	case "tcp":
-		return pingerTCP(target.Addr, reporter, target.Rule)
+		return pingerTCP(addr, reporter, rule)
+	case "udp":
+		return pingerUDP(addr, reporter, rule)
+	case "transaction":
+		return pingerTransaction(addr, reporter, rule)
+	case "websocket":
+		return pingerWebSocket(addr, reporter, rule)
+	case "sse":
+		return pingerSSE(addr, reporter, rule)
+	case "grpc":
+		return pingerGRPC(addr, reporter, rule)
 	case "icmp":
-		return pingerICMP(target.Addr, reporter, target.Rule)
+		return pingerICMP(addr, reporter, rule)
 	case "mysql":
-		return pingerMysql(target.Addr, reporter, target.Rule)
+		return pingerMysql(addr, reporter, rule)
 	default:
-		return fmt.Errorf("no handler for rule type %s", target.Rule.Type)
+		return fmt.Errorf("no handler for rule type %s", rule.Type)
 	}
 }
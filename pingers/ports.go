@@ -0,0 +1,96 @@
+package pingers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// states of a port, open ports accept connections or reply, refused ports reject them and
+// filtered ports do not answer or are blocked by a firewall
+const (
+	portOpen     = "open"
+	portClosed   = "closed" // refused or filtered
+	portRefused  = "refused"
+	portFiltered = "filtered"
+	portError    = "error" // the state cannot be known, e.g. the host cannot be resolved
+)
+
+// expectsClosed returns true if the rule asserts that its port is not reachable
+func (r *Rule) expectsClosed() bool {
+	return r.Expect == portClosed || r.Expect == portRefused || r.Expect == portFiltered
+}
+
+// portState returns the state of a port from the error of a connection attempt
+func portState(err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return portOpen
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return portRefused
+	case errors.As(err, &netErr) && netErr.Timeout(),
+		errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EACCES):
+		return portFiltered
+	}
+	return portError
+}
+
+// reportPortState reports the state of the port of addr, the probe succeeds if it is the expected one
+func reportPortState(state string, addr string, reporter MetricReporter, c *Rule) error {
+	labels := addrLabel(addr, c.tags)
+	reporter.ReportInfo("port_state_info", labels, map[string]string{"state": state})
+	ok := state == c.Expect || (c.Expect == portClosed && (state == portRefused || state == portFiltered))
+	reporter.ReportSuccess(ok, c.MetricName, labels)
+	if !ok {
+		return fmt.Errorf("port state of %s is %s, expected %s", addr, state, c.Expect)
+	}
+	return nil
+}
+
+// maxExpandedPorts is the max number of ports of a target with a list of ports, each being probed
+const maxExpandedPorts = 256
+
+// expandPorts returns the host:port addresses of addr, a host with a list of ports and port ranges
+// like host:22,80,8000-8010, with at most maxExpandedPorts ports
+func expandPorts(addr string) ([]string, error) {
+	host, ports, err := net.SplitHostPort(addr)
+	if err != nil || !strings.ContainsAny(ports, ",-") {
+		return []string{addr}, nil
+	}
+	addrs := []string{}
+	for _, portRange := range strings.Split(ports, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(portRange), "-", 2)
+		first, err := parsePort(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid port list in %s, %v", addr, err)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = parsePort(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid port list in %s, %v", addr, err)
+			}
+		}
+		if last < first {
+			return nil, fmt.Errorf("invalid port range %s in %s", portRange, addr)
+		}
+		if len(addrs)+last-first+1 > maxExpandedPorts {
+			return nil, fmt.Errorf("too many ports in %s, at most %d ports can be probed", addr, maxExpandedPorts)
+		}
+		for port := first; port <= last; port++ {
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+	return addrs, nil
+}
+
+func parsePort(port string) (int, error) {
+	p, err := strconv.Atoi(strings.TrimSpace(port))
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %s", port)
+	}
+	return p, nil
+}
@@ -0,0 +1,113 @@
+package pingers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestExpandPorts(t *testing.T) {
+	tests := []struct {
+		addr string
+		want []string // nil if an error is expected
+	}{
+		{"host:80", []string{"host:80"}},
+		{"host", []string{"host"}},
+		{"host:22,80", []string{"host:22", "host:80"}},
+		{"host:8000-8002", []string{"host:8000", "host:8001", "host:8002"}},
+		{"host:22, 80-81", []string{"host:22", "host:80", "host:81"}},
+		{"host:443-443", []string{"host:443"}},
+		{"[::1]:22,80", []string{"[::1]:22", "[::1]:80"}},
+		{"host:81-80", nil},
+		{"host:0,80", nil},
+		{"host:80,65536", nil},
+		{"host:80,", nil},
+		{"host:a-b", nil},
+		{"host:80-", nil},
+	}
+	for _, test := range tests {
+		got, err := expandPorts(test.addr)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("expandPorts(%s) = %v, expected an error", test.addr, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("expandPorts(%s) = %v, %v, expected %v", test.addr, got, err, test.want)
+		}
+	}
+}
+
+func TestExpandPortsLimit(t *testing.T) {
+	if addrs, err := expandPorts("host:1-256"); err != nil || len(addrs) != maxExpandedPorts {
+		t.Errorf("got %d addresses, %v, expected %d", len(addrs), err, maxExpandedPorts)
+	}
+	for _, addr := range []string{"host:1-65535", "host:1-256,300", "host:1-200,1000-1100"} {
+		if addrs, err := expandPorts(addr); err == nil {
+			t.Errorf("expandPorts(%s) returned %d addresses, expected an error", addr, len(addrs))
+		}
+	}
+}
+
+func TestRuleExpect(t *testing.T) {
+	for _, ruleType := range []string{"tcp", "udp"} {
+		for _, expect := range []string{portOpen, portClosed, portRefused, portFiltered} {
+			r := &Rule{Type: ruleType, Expect: expect, UDPRule: &UDPRule{Send: "ping"}}
+			if err := r.setup(); err != nil {
+				t.Errorf("expect %s on %s rule: %v", expect, ruleType, err)
+			}
+		}
+	}
+	for _, ruleType := range []string{"http", "icmp", "mysql", "grpc", "websocket"} {
+		for _, expect := range []string{portOpen, portClosed} {
+			if err := (&Rule{Type: ruleType, Expect: expect}).setup(); err == nil {
+				t.Errorf("expect %s on %s rule accepted, expected an error", expect, ruleType)
+			}
+		}
+	}
+	if err := (&Rule{Type: "tcp", Expect: "up"}).setup(); err == nil {
+		t.Errorf("expect up accepted, expected an error")
+	}
+}
+
+func TestPortState(t *testing.T) {
+	opError := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: err}}
+	}
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, portOpen},
+		{opError(syscall.ECONNREFUSED), portRefused},
+		{fmt.Errorf("read, %w", syscall.ECONNREFUSED), portRefused},
+		{opError(syscall.EHOSTUNREACH), portFiltered},
+		{opError(syscall.ENETUNREACH), portFiltered},
+		{opError(syscall.EACCES), portFiltered},
+		{&net.DNSError{Err: "timeout", Name: "host", IsTimeout: true}, portFiltered},
+		{&net.DNSError{Err: "no such host", Name: "host", IsNotFound: true}, portError},
+		{errors.New("other"), portError},
+	}
+	for _, test := range tests {
+		if state := portState(test.err); state != test.want {
+			t.Errorf("portState(%v) = %s, expected %s", test.err, state, test.want)
+		}
+	}
+
+	// a closed local port refuses connections
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, err = net.Dial("tcp", addr)
+	if state := portState(err); state != portRefused {
+		t.Errorf("got %s for %v, expected %s", state, err, portRefused)
+	}
+}
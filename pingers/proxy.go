@@ -0,0 +1,304 @@
+package pingers
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyError is returned when connecting through a proxy fails because of the proxy itself,
+// as opposed to the proxy not being able to reach the target
+type proxyError struct {
+	err error
+}
+
+func (e *proxyError) Error() string {
+	return fmt.Sprintf("proxy error: %v", e.err)
+}
+
+// isProxyError returns true if err happened while talking to the proxy rather than to the target
+func isProxyError(err error) bool {
+	var pErr *proxyError
+	if errors.As(err, &pErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "proxyconnect"
+}
+
+// parseProxyURL parses and validates a proxy URL, supported schemes are http, https, socks5 and socks5h
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse proxy_url %s, %v", proxyURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy_url scheme %s, expected http, https, socks5 or socks5h", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy_url %s has no host", proxyURL)
+	}
+	return u, nil
+}
+
+// urlPort returns the port of u, the default port of its scheme if missing
+func urlPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Port()
+	}
+	switch u.Scheme {
+	case "https", "wss":
+		return "443"
+	}
+	return "80"
+}
+
+// proxyHostPort returns the host:port of the proxy, with the default port of its scheme if missing
+func proxyHostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "http":
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+	return net.JoinHostPort(u.Hostname(), "1080")
+}
+
+// connectStatusError returns the error for an HTTP CONNECT response with a status other than 200.
+// Bad gateway and gateway timeout mean the proxy could not reach the target, others are proxy errors.
+func connectStatusError(status string, statusCode int) error {
+	err := fmt.Errorf("CONNECT failed with status %s", status)
+	if statusCode == http.StatusBadGateway || statusCode == http.StatusGatewayTimeout {
+		return err
+	}
+	return &proxyError{err}
+}
+
+// matchNoProxy returns true if host and port match one of the hosts, domains, IPs or CIDRs of noProxy.
+// Hosts, domains and IPs followed by a port only match this port.
+func matchNoProxy(host string, port string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entryHost, entryPort, err := net.SplitHostPort(entry); err == nil {
+			if entryPort != port {
+				continue
+			}
+			entry = entryHost
+		}
+		if entry == "*" || entry == host {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(entry, ".")
+		if ip == nil && strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialProxy connects to addr through the proxy, using HTTP CONNECT for http and https proxies
+// and SOCKS5 for socks5 and socks5h proxies. With socks5, the host of addr is resolved by the prober
+// with the preferred IP protocol of the rule and the proxy gets its address, with socks5h the proxy
+// gets the host name and resolves it.
+func (r *Rule) dialProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	if proxyURL.Scheme == "socks5" {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ip, err := r.resolveIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(ip.String(), port)
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyHostPort(proxyURL))
+	if err != nil {
+		return nil, &proxyError{err}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, &proxyError{err}
+		}
+		conn = tlsConn
+	}
+	var tunnel net.Conn
+	if strings.HasPrefix(proxyURL.Scheme, "socks5") {
+		tunnel, err = socks5Connect(conn, proxyURL, addr)
+	} else {
+		tunnel, err = httpConnect(conn, proxyURL, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read in a buffer
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func httpConnect(conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, &proxyError{err}
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, &proxyError{err}
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, connectStatusError(resp.Status, resp.StatusCode)
+	}
+	return &bufferedConn{conn, r}, nil
+}
+
+// socks5 reply codes meaning that the proxy could not reach the target
+var socks5TargetErrors = map[byte]string{
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+}
+
+func socks5Connect(conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", portStr)
+	}
+
+	method := byte(0x00)
+	if proxyURL.User != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return nil, &proxyError{err}
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, &proxyError{err}
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return nil, &proxyError{fmt.Errorf("socks5 authentication method not accepted")}
+	}
+	if method == 0x02 {
+		user := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return nil, &proxyError{fmt.Errorf("socks5 username and password must be shorter than 256 bytes")}
+		}
+		auth := append([]byte{1, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, &proxyError{err}
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, &proxyError{err}
+		}
+		if reply[1] != 0 {
+			return nil, &proxyError{fmt.Errorf("socks5 authentication failed")}
+		}
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, 1), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, 4), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %s is too long", host)
+		}
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return nil, &proxyError{err}
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, &proxyError{err}
+	}
+	if header[1] != 0 {
+		if reason, ok := socks5TargetErrors[header[1]]; ok {
+			return nil, fmt.Errorf("socks5 proxy cannot connect to %s, %s", addr, reason)
+		}
+		return nil, &proxyError{fmt.Errorf("socks5 connect failed with code %d", header[1])}
+	}
+	// skip the bound address and port
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = net.IPv4len + 2
+	case 4:
+		skip = net.IPv6len + 2
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, &proxyError{err}
+		}
+		skip = int(length[0]) + 2
+	default:
+		return nil, &proxyError{fmt.Errorf("socks5 reply has unknown address type %d", header[3])}
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip)); err != nil {
+		return nil, &proxyError{err}
+	}
+	return conn, nil
+}
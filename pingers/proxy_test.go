@@ -0,0 +1,297 @@
+package pingers
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// echoServer returns the address of a TCP server sending back what it receives
+func echoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// serveProxy runs handle on each connection accepted by a local listener and returns its address
+func serveProxy(t *testing.T, handle func(net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// tunnel connects client to addr and copies the data both ways
+func tunnel(client io.ReadWriter, addr string) {
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	go io.Copy(target, client)
+	io.Copy(client, target)
+}
+
+// connectProxy is an HTTP CONNECT proxy requiring user:password, it answers 502 for port 1
+func connectProxy(t *testing.T) string {
+	return serveProxy(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:password"))
+		switch {
+		case req.Method != http.MethodConnect:
+			io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		case req.Header.Get("Proxy-Authorization") != auth:
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		case req.Host == "127.0.0.1:1":
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		default:
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			tunnel(struct {
+				io.Reader
+				io.Writer
+			}{r, conn}, req.Host)
+		}
+	})
+}
+
+// socks5Proxy is a SOCKS5 proxy requiring user:password, it replies with the code given by the
+// port of the target if it is lower than 10
+func socks5Proxy(t *testing.T) string {
+	return serveProxy(t, func(conn net.Conn) {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		methods := make([]byte, header[1])
+		io.ReadFull(conn, methods)
+		conn.Write([]byte{5, 2})
+		// username and password authentication
+		io.ReadFull(conn, header)
+		user := make([]byte, header[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, header[:1])
+		password := make([]byte, header[0])
+		io.ReadFull(conn, password)
+		if string(user) != "user" || string(password) != "password" {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+
+		req := make([]byte, 4)
+		io.ReadFull(conn, req)
+		var host string
+		switch req[3] {
+		case 1:
+			ip := make([]byte, net.IPv4len)
+			io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case 4:
+			ip := make([]byte, net.IPv6len)
+			io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case 3:
+			io.ReadFull(conn, header[:1])
+			name := make([]byte, header[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		}
+		io.ReadFull(conn, header)
+		port := int(binary.BigEndian.Uint16(header))
+		code := byte(0)
+		if port < 10 {
+			code = byte(port)
+		}
+		// the bound address is a domain name, to check it is skipped
+		conn.Write([]byte{5, code, 0, 3, 5, 'l', 'o', 'c', 'a', 'l', 0, 0})
+		if code == 0 {
+			tunnel(conn, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	})
+}
+
+func TestDialProxy(t *testing.T) {
+	target := echoServer(t)
+	httpProxy := connectProxy(t)
+	socksProxy := socks5Proxy(t)
+	tests := []struct {
+		name       string
+		proxyURL   string
+		addr       string
+		proxyError bool // expected error, if any, is an error of the proxy
+		ok         bool
+	}{
+		{"http connect", "http://user:password@" + httpProxy, target, false, true},
+		{"http wrong password", "http://user:wrong@" + httpProxy, target, true, false},
+		{"http no credentials", "http://" + httpProxy, target, true, false},
+		{"http bad gateway", "http://user:password@" + httpProxy, "127.0.0.1:1", false, false},
+		{"http proxy down", "http://127.0.0.1:1", target, true, false},
+		{"socks5 connect", "socks5://user:password@" + socksProxy, target, false, true},
+		{"socks5 host name", "socks5h://user:password@" + socksProxy, "localhost:" + target[len("127.0.0.1:"):], false, true},
+		{"socks5 wrong password", "socks5://user:wrong@" + socksProxy, target, true, false},
+		{"socks5 general failure", "socks5://user:password@" + socksProxy, "127.0.0.1:1", true, false},
+		{"socks5 host unreachable", "socks5://user:password@" + socksProxy, "127.0.0.1:4", false, false},
+		{"socks5 connection refused", "socks5://user:password@" + socksProxy, "127.0.0.1:5", false, false},
+	}
+	for _, test := range tests {
+		proxyURL, err := parseProxyURL(test.proxyURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		conn, err := (&Rule{}).dialProxy(ctx, proxyURL, test.addr)
+		cancel()
+		if !test.ok {
+			if err == nil {
+				conn.Close()
+				t.Errorf("%s: connected, expected an error", test.name)
+			} else if isProxyError(err) != test.proxyError {
+				t.Errorf("%s: got error %v, expected a proxy error to be %t", test.name, err, test.proxyError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		io.WriteString(conn, "ping")
+		reply := make([]byte, 4)
+		if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+			t.Errorf("%s: got %q, %v through the tunnel, expected ping", test.name, reply, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestDialProxyResolution(t *testing.T) {
+	target := echoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	socksProxy := socks5Proxy(t)
+	// proxied.test is only known by the prober, its IPv6 address is unreachable
+	fakeLookupIP(t, []string{"127.0.0.1"}, []string{"100::1"})
+	tests := []struct {
+		name     string
+		proxyURL string
+		rule     *Rule
+		ok       bool
+	}{
+		{"socks5 resolved by the prober", "socks5://user:password@" + socksProxy, &Rule{PreferredIPProtocol: "ip4"}, true},
+		{"socks5 resolved with the preferred protocol", "socks5://user:password@" + socksProxy, &Rule{PreferredIPProtocol: "ip6"}, false},
+		{"socks5h resolved by the proxy", "socks5h://user:password@" + socksProxy, &Rule{PreferredIPProtocol: "ip4"}, false},
+	}
+	for _, test := range tests {
+		proxyURL, err := parseProxyURL(test.proxyURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		conn, err := test.rule.dialProxy(ctx, proxyURL, net.JoinHostPort("proxied.test", port))
+		cancel()
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		// the proxy accepts the connection before reaching the target, which closes the tunnel if unreachable
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		io.WriteString(conn, "ping")
+		reply := make([]byte, 4)
+		_, err = io.ReadFull(conn, reply)
+		conn.Close()
+		if (err == nil && string(reply) == "ping") != test.ok {
+			t.Errorf("%s: got %q, %v through the tunnel, expected the target to be reached to be %t", test.name, reply, err, test.ok)
+		}
+	}
+}
+
+func TestParseProxyURL(t *testing.T) {
+	for _, proxyURL := range []string{"http://proxy:3128", "https://proxy", "socks5://u:p@proxy:1080", "socks5h://proxy"} {
+		if _, err := parseProxyURL(proxyURL); err != nil {
+			t.Errorf("parseProxyURL(%s) failed, %v", proxyURL, err)
+		}
+	}
+	for _, proxyURL := range []string{"ftp://proxy", "proxy:3128", "http://", "://"} {
+		if _, err := parseProxyURL(proxyURL); err == nil {
+			t.Errorf("parseProxyURL(%s) succeeded, expected an error", proxyURL)
+		}
+	}
+	u, _ := url.Parse("socks5://proxy")
+	if hostPort := proxyHostPort(u); hostPort != "proxy:1080" {
+		t.Errorf("got %s, expected the default socks5 port", hostPort)
+	}
+}
+
+func TestMatchNoProxy(t *testing.T) {
+	noProxy := []string{"localhost", ".internal.example.com", "example.org", "10.0.0.0/8", "192.168.1.1", "metrics.example.com:9100", "[::1]:8080"}
+	tests := []struct {
+		host  string
+		port  string
+		match bool
+	}{
+		{"localhost", "80", true},
+		{"LOCALHOST", "80", true},
+		{"internal.example.com", "443", false}, // a leading dot matches subdomains only
+		{"api.internal.example.com", "443", true},
+		{"example.org", "443", true},
+		{"www.example.org", "443", true},
+		{"badexample.org", "443", false},
+		{"example.com", "443", false},
+		{"10.1.2.3", "80", true},
+		{"11.1.2.3", "80", false},
+		{"192.168.1.1", "80", true},
+		{"192.168.1.2", "80", false},
+		{"metrics.example.com", "9100", true},
+		{"metrics.example.com", "443", false},
+		{"::1", "8080", true},
+		{"::1", "80", false},
+	}
+	for _, test := range tests {
+		if match := matchNoProxy(test.host, test.port, noProxy); match != test.match {
+			t.Errorf("matchNoProxy(%s, %s) = %t, expected %t", test.host, test.port, match, test.match)
+		}
+	}
+	if !matchNoProxy("anything", "1", []string{"*"}) {
+		t.Errorf("* must match every host")
+	}
+}
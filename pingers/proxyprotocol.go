@@ -0,0 +1,84 @@
+package pingers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// proxyProtocolV2Signature starts the headers of the version 2 of the PROXY protocol
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// parseProxyProtocolSource parses the source address sent in PROXY protocol headers, an IP with an optional port
+func parseProxyProtocolSource(source string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(source); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	host, port, err := net.SplitHostPort(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy_protocol_source %s, expected an IP and an optional port", source)
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid proxy_protocol_source %s, expected an IP and an optional port", source)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// writeProxyHeader writes the PROXY protocol header of the rule on a new connection.
+// The source is the one of the rule, the local address of the connection by default,
+// and the destination is the remote address of the connection.
+func (r *Rule) writeProxyHeader(conn net.Conn) error {
+	src, ok := conn.LocalAddr().(*net.TCPAddr)
+	dst, ok2 := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !ok2 {
+		return fmt.Errorf("PROXY protocol requires a TCP connection")
+	}
+	if r.proxyProtocolSource != nil {
+		port := src.Port
+		if r.proxyProtocolSource.Port != 0 {
+			port = r.proxyProtocolSource.Port
+		}
+		src = &net.TCPAddr{IP: r.proxyProtocolSource.IP, Port: port}
+	}
+	_, err := conn.Write(proxyHeader(r.ProxyProtocol, src, dst))
+	return err
+}
+
+// proxyHeader returns the header of the given version of the PROXY protocol, both addresses are
+// sent as IPv6 addresses if one of them is
+func proxyHeader(version string, src, dst *net.TCPAddr) []byte {
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	ipv4 := srcIP != nil && dstIP != nil
+	if !ipv4 {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	if version == "v1" {
+		family := "TCP4"
+		if !ipv4 {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, proxyHeaderIP(srcIP, ipv4), proxyHeaderIP(dstIP, ipv4), src.Port, dst.Port))
+	}
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	// version 2 and PROXY command, then the address family with the STREAM protocol
+	header = append(header, 0x21, 0x11)
+	if !ipv4 {
+		header[len(header)-1] = 0x21
+	}
+	addrs := append(append([]byte{}, srcIP...), dstIP...)
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// proxyHeaderIP formats ip for a version 1 header, IPv4 addresses are mapped to IPv6 in TCP6 headers
+func proxyHeaderIP(ip net.IP, ipv4 bool) string {
+	if !ipv4 && ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
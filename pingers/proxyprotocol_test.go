@@ -0,0 +1,70 @@
+package pingers
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestParseProxyProtocolSource(t *testing.T) {
+	tests := []struct {
+		source string
+		ip     string
+		port   int
+		err    bool
+	}{
+		{"203.0.113.7", "203.0.113.7", 0, false},
+		{"203.0.113.7:4000", "203.0.113.7", 4000, false},
+		{"2001:db8::1", "2001:db8::1", 0, false},
+		{"[2001:db8::1]:4000", "2001:db8::1", 4000, false},
+		{"", "", 0, true},
+		{"host.example.com", "", 0, true},
+		{"host.example.com:4000", "", 0, true},
+		{"203.0.113.7:65536", "", 0, true},
+		{"203.0.113.7:port", "", 0, true},
+		{"2001:db8::1:4000:x", "", 0, true},
+	}
+	for _, test := range tests {
+		addr, err := parseProxyProtocolSource(test.source)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseProxyProtocolSource(%s) = %v, expected an error", test.source, addr)
+			}
+			continue
+		}
+		if err != nil || !addr.IP.Equal(net.ParseIP(test.ip)) || addr.Port != test.port {
+			t.Errorf("parseProxyProtocolSource(%s) = %v, %v, expected %s port %d", test.source, addr, err, test.ip, test.port)
+		}
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	signature := string(proxyProtocolV2Signature)
+	tests := []struct {
+		name     string
+		version  string
+		src, dst *net.TCPAddr
+		want     string
+	}{
+		{"v1 ipv4", "v1", v4src, v4dst, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"},
+		{"v1 ipv6", "v1", v6src, v6dst, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"},
+		{"v1 mixed", "v1", v4src, v6dst, "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n"},
+		{"v2 ipv4", "v2", v4src, v4dst, signature + "\x21\x11\x00\x0c" +
+			"\xc0\x00\x02\x01" + "\xc6\x33\x64\x02" + "\xdc\x04" + "\x01\xbb"},
+		{"v2 ipv6", "v2", v6src, v6dst, signature + "\x21\x21\x00\x24" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" + "\xdc\x04" + "\x01\xbb"},
+		{"v2 mixed", "v2", v6src, v4dst, signature + "\x21\x21\x00\x24" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+			"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xc6\x33\x64\x02" + "\xdc\x04" + "\x01\xbb"},
+	}
+	for _, test := range tests {
+		if header := proxyHeader(test.version, test.src, test.dst); !bytes.Equal(header, []byte(test.want)) {
+			t.Errorf("%s: got %q, expected %q", test.name, header, test.want)
+		}
+	}
+}
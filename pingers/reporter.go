@@ -1,13 +1,20 @@
 package pingers
 
 import (
+	"log"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 const urlTag = "url"
 const hostTag = "host"
+const checkTag = "check"
+const valueTag = "value"
+const infoSuffix = "_info"
 
 // MetricMaker creates metrics to be reported later on
 type MetricMaker interface {
@@ -21,6 +28,9 @@ type MetricReporter interface {
 	ReportHttpStatus(status int, labels map[string]string)
 	ReportSuccess(success bool, metricName string, labels map[string]string)
 	ReportValue(val float64, metricName string, labels map[string]string)
+	ReportInfo(metricName string, labels map[string]string, info map[string]string)
+	DeleteSeries(labels map[string]string)
+	DeleteStaleSeries(metricName string, labels map[string]string, current []map[string]string)
 }
 
 type Reporter struct {
@@ -32,6 +42,7 @@ type Reporter struct {
 	size         *prometheus.GaugeVec
 	httpStatus   *prometheus.GaugeVec
 	otherMetrics map[string]*prometheus.GaugeVec
+	infos        map[string]map[string]string // last labels reported by ReportInfo, by metric and labels
 }
 
 func NewReporter(namespace string, tags map[string]string) *Reporter {
@@ -63,19 +74,20 @@ func NewReporter(namespace string, tags map[string]string) *Reporter {
 			Help:      "HTTP response code.",
 		}, tagNames),
 		otherMetrics: make(map[string]*prometheus.GaugeVec),
+		infos:        make(map[string]map[string]string),
 	}
 }
 
 func (r *Reporter) ReportLatency(latency float64, labels map[string]string) {
-	r.size.With(labels).Set(float64(latency))
+	setGauge(r.latency, "latency_seconds", labels, latency)
 }
 
 func (r *Reporter) ReportSize(size int, labels map[string]string) {
-	r.size.With(labels).Set(float64(size))
+	setGauge(r.size, "size_bytes", labels, float64(size))
 }
 
 func (r *Reporter) ReportHttpStatus(status int, labels map[string]string) {
-	r.httpStatus.With(labels).Set(float64(status))
+	setGauge(r.httpStatus, "response_code", labels, float64(status))
 }
 
 func (r *Reporter) ReportSuccess(success bool, metricName string, labels map[string]string) {
@@ -87,27 +99,138 @@ func (r *Reporter) ReportSuccess(success bool, metricName string, labels map[str
 }
 
 func (r *Reporter) ReportValue(val float64, metricName string, labels map[string]string) {
-	metric := r.getMetric(metricName)
-	metric.With(labels).Set(val)
+	setGauge(r.getMetric(metricName, labels), metricName, labels, val)
 }
 
-func (r *Reporter) getMetric(name string) *prometheus.GaugeVec {
+// setGauge sets the series of metric having labels to val. A sample whose label names are not
+// those of the metric is logged and dropped.
+func setGauge(metric *prometheus.GaugeVec, metricName string, labels map[string]string, val float64) {
+	gauge, err := metric.GetMetricWith(labels)
+	if err != nil {
+		log.Printf("cannot report metric %s with labels %v, %v", metricName, labels, err)
+		return
+	}
+	gauge.Set(val)
+}
+
+// ReportInfo sets to 1 the series of metricName having both labels and info labels.
+// The series previously reported for the same labels with other info labels is deleted.
+func (r *Reporter) ReportInfo(metricName string, labels map[string]string, info map[string]string) {
+	allLabels := make(map[string]string, len(labels)+len(info))
+	for key, val := range labels {
+		allLabels[key] = val
+	}
+	for key, val := range info {
+		allLabels[key] = val
+	}
+	metric := r.getMetric(metricName, allLabels)
+	key := metricName + labelsKey(labels)
+	r.mu.Lock()
+	if previous, ok := r.infos[key]; ok {
+		metric.Delete(previous)
+	}
+	r.infos[key] = allLabels
+	// set under the lock, so that a concurrent report cannot delete the new series
+	setGauge(metric, metricName, allLabels, 1)
+	r.mu.Unlock()
+}
+
+// DeleteSeries deletes the series of all the metrics having labels, among others, like the series of an
+// address of a target which is not resolved anymore
+func (r *Reporter) DeleteSeries(labels map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	metrics := map[string]*prometheus.GaugeVec{
+		"latency_seconds": r.latency, "size_bytes": r.size, "response_code": r.httpStatus,
+	}
+	for name, metric := range r.otherMetrics {
+		metrics[name] = metric
+	}
+	for name, metric := range metrics {
+		r.deleteSeries(name, metric, labels, nil)
+	}
+}
+
+// DeleteStaleSeries deletes the series of metricName having labels, among others, but not the labels of
+// one of current, like the series of a previous probe with label values not reported anymore
+func (r *Reporter) DeleteStaleSeries(metricName string, labels map[string]string, current []map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if metric, ok := r.otherMetrics[metricName]; ok {
+		keep := make(map[string]bool, len(current))
+		for _, series := range current {
+			keep[labelsKey(series)] = true
+		}
+		r.deleteSeries(metricName, metric, labels, keep)
+	}
+}
+
+// deleteSeries deletes the series of metric having labels and whose key is not in keep, r.mu must be held
+func (r *Reporter) deleteSeries(metricName string, metric *prometheus.GaugeVec, labels map[string]string, keep map[string]bool) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		metric.Collect(ch)
+		close(ch)
+	}()
+	stale := []map[string]string{}
+	for m := range ch {
+		var series dto.Metric
+		if err := m.Write(&series); err != nil {
+			continue
+		}
+		seriesLabels := make(map[string]string, len(series.Label))
+		for _, pair := range series.Label {
+			seriesLabels[pair.GetName()] = pair.GetValue()
+		}
+		if hasLabels(seriesLabels, labels) && !keep[labelsKey(seriesLabels)] {
+			stale = append(stale, seriesLabels)
+		}
+	}
+	deleted := make(map[string]bool, len(stale))
+	for _, seriesLabels := range stale {
+		metric.Delete(seriesLabels)
+		deleted[labelsKey(seriesLabels)] = true
+	}
+	for key, infoLabels := range r.infos {
+		if strings.HasPrefix(key, metricName+"\xff") && deleted[labelsKey(infoLabels)] {
+			delete(r.infos, key)
+		}
+	}
+}
+
+// hasLabels returns true if all the labels are in seriesLabels, with the same values
+func hasLabels(seriesLabels map[string]string, labels map[string]string) bool {
+	for name, value := range labels {
+		if v, ok := seriesLabels[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// getMetric returns the metric with the given name, creating it with the label names of labels if needed.
+// A given metric name must always be reported with the same label names, other samples are dropped by setGauge.
+func (r *Reporter) getMetric(name string, labels map[string]string) *prometheus.GaugeVec {
 	var metric *prometheus.GaugeVec
 	ok := false
 	r.mu.Lock()
 	if metric, ok = r.otherMetrics[name]; !ok {
-		metric = r.makeMetric(name)
+		metric = r.makeMetric(name, labels)
 	}
 	r.mu.Unlock()
 	return metric
 }
 
-func (r *Reporter) makeMetric(name string) *prometheus.GaugeVec {
+func (r *Reporter) makeMetric(name string, labels map[string]string) *prometheus.GaugeVec {
+	labelNames := make([]string, 0, len(labels))
+	for labelName := range labels {
+		labelNames = append(labelNames, labelName)
+	}
 	metric := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: r.namespace,
 		Name:      name,
 		Help:      name,
-	}, r.tagNames)
+	}, labelNames)
 	r.otherMetrics[name] = metric
 	return metric
 }
@@ -132,6 +255,70 @@ func (r *Reporter) Describe(ch chan<- *prometheus.Desc) {
 	}
 }
 
+// labeledReporter reports the metrics of a part of a probe, like one of the addresses of the target,
+// under names with a prefix and with an extra label. It records whether this part succeeded.
+type labeledReporter struct {
+	MetricReporter
+	prefix     string
+	label      string
+	value      string
+	metricName string
+	healthy    bool
+}
+
+func newLabeledReporter(reporter MetricReporter, prefix string, label string, value string, metricName string) *labeledReporter {
+	return &labeledReporter{
+		MetricReporter: reporter,
+		prefix:         prefix,
+		label:          label,
+		value:          value,
+		metricName:     metricName,
+	}
+}
+
+func (r *labeledReporter) ReportLatency(latency float64, labels map[string]string) {
+	r.ReportValue(latency, "latency_seconds", labels)
+}
+
+func (r *labeledReporter) ReportSize(size int, labels map[string]string) {
+	r.ReportValue(float64(size), "size_bytes", labels)
+}
+
+func (r *labeledReporter) ReportHttpStatus(status int, labels map[string]string) {
+	r.ReportValue(float64(status), "response_code", labels)
+}
+
+func (r *labeledReporter) ReportSuccess(success bool, metricName string, labels map[string]string) {
+	if metricName == r.metricName {
+		r.healthy = success
+	}
+	successValue := 0
+	if success {
+		successValue = 1
+	}
+	r.ReportValue(float64(successValue), metricName, labels)
+}
+
+func (r *labeledReporter) ReportValue(val float64, metricName string, labels map[string]string) {
+	r.MetricReporter.ReportValue(val, r.prefix+metricName, withLabel(labels, r.label, r.value))
+}
+
+func (r *labeledReporter) ReportInfo(metricName string, labels map[string]string, info map[string]string) {
+	r.MetricReporter.ReportInfo(r.prefix+metricName, withLabel(labels, r.label, r.value), info)
+}
+
+func (r *labeledReporter) DeleteSeries(labels map[string]string) {
+	r.MetricReporter.DeleteSeries(withLabel(labels, r.label, r.value))
+}
+
+func (r *labeledReporter) DeleteStaleSeries(metricName string, labels map[string]string, current []map[string]string) {
+	labeled := make([]map[string]string, len(current))
+	for i, series := range current {
+		labeled[i] = withLabel(series, r.label, r.value)
+	}
+	r.MetricReporter.DeleteStaleSeries(r.prefix+metricName, withLabel(labels, r.label, r.value), labeled)
+}
+
 func pingerLabels(addr string, hostname string, others map[string]string) map[string]string {
 	labels := make(map[string]string)
 	for key, val := range others {
@@ -141,3 +328,27 @@ func pingerLabels(addr string, hostname string, others map[string]string) map[st
 	labels[urlTag] = addr
 	return labels
 }
+
+// labelsKey returns a string identifying the label set
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := ""
+	for _, name := range names {
+		key += "\xff" + name + "=" + labels[name]
+	}
+	return key
+}
+
+// withLabel returns a copy of labels with the extra label name set to value
+func withLabel(labels map[string]string, name string, value string) map[string]string {
+	newLabels := make(map[string]string, len(labels)+1)
+	for key, val := range labels {
+		newLabels[key] = val
+	}
+	newLabels[name] = value
+	return newLabels
+}
@@ -0,0 +1,138 @@
+package pingers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// collect returns the values of the series of the reporter, by metric name and label values
+func collect(t *testing.T, r *Reporter) map[string]float64 {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(r); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, m := range family.Metric {
+			values[family.GetName()+seriesKey(m)] = m.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+func seriesKey(m *dto.Metric) string {
+	labels := map[string]string{}
+	for _, pair := range m.Label {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return labelsKey(labels)
+}
+
+func TestReportValueWithOtherLabelNames(t *testing.T) {
+	r := NewReporter("", nil)
+	labels := pingerLabels("http://a/", "a", nil)
+	r.ReportValue(1, "extracted", labels)
+	// a different label set must be dropped, not panic
+	r.ReportValue(2, "extracted", withLabel(labels, "other", "x"))
+	r.ReportLatency(0.5, withLabel(labels, "other", "x"))
+
+	values := collect(t, r)
+	if len(values) != 1 || values["extracted"+labelsKey(labels)] != 1 {
+		t.Errorf("got %v, expected only extracted with the labels of the first sample", values)
+	}
+}
+
+func TestReportInfoReplacesPreviousSeries(t *testing.T) {
+	r := NewReporter("", nil)
+	labels := pingerLabels("http://a/", "a", nil)
+	r.ReportInfo("version_info", labels, map[string]string{valueTag: "1.0"})
+	r.ReportInfo("version_info", labels, map[string]string{valueTag: "1.1"})
+
+	values := collect(t, r)
+	if len(values) != 1 || values["version_info"+labelsKey(withLabel(labels, valueTag, "1.1"))] != 1 {
+		t.Errorf("got %v, expected only version_info with value 1.1", values)
+	}
+}
+
+func TestReportInfoConcurrently(t *testing.T) {
+	r := NewReporter("", nil)
+	labels := pingerLabels("http://a/", "a", nil)
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			for j := 0; j < 100; j++ {
+				r.ReportInfo("version_info", labels, map[string]string{valueTag: string(rune('a' + (i+j)%3))})
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	if values := collect(t, r); len(values) != 1 {
+		t.Errorf("got %v, expected a single version_info series", values)
+	}
+}
+
+func TestReportLatency(t *testing.T) {
+	r := NewReporter("", nil)
+	labels := pingerLabels("http://a/", "a", nil)
+	r.ReportSize(1024, labels)
+	r.ReportLatency(0.25, labels)
+
+	values := collect(t, r)
+	if values["latency_seconds"+labelsKey(labels)] != 0.25 || values["size_bytes"+labelsKey(labels)] != 1024 {
+		t.Errorf("got %v, expected latency_seconds 0.25 and size_bytes 1024", values)
+	}
+}
+
+func TestDeleteSeries(t *testing.T) {
+	r := NewReporter("", nil)
+	labels := pingerLabels("http://a/", "a", nil)
+	other := pingerLabels("http://b/", "b", nil)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		ipReporter := newLabeledReporter(r, ipMetricPrefix, ipTag, ip, DefaultMetricName)
+		ipReporter.ReportSuccess(true, DefaultMetricName, labels)
+		ipReporter.ReportLatency(0.1, labels)
+		ipReporter.ReportInfo("version_info", labels, map[string]string{valueTag: "1.0"})
+	}
+	r.ReportSuccess(true, ipMetricPrefix+DefaultMetricName, withLabel(other, ipTag, "10.0.0.2"))
+
+	r.DeleteSeries(withLabel(labels, ipTag, "10.0.0.2"))
+	values := collect(t, r)
+	for _, name := range []string{DefaultMetricName, "latency_seconds"} {
+		if _, ok := values[ipMetricPrefix+name+labelsKey(withLabel(labels, ipTag, "10.0.0.2"))]; ok {
+			t.Errorf("got %v, expected the %s series of 10.0.0.2 to be deleted", values, name)
+		}
+		if _, ok := values[ipMetricPrefix+name+labelsKey(withLabel(labels, ipTag, "10.0.0.1"))]; !ok {
+			t.Errorf("got %v, expected the %s series of 10.0.0.1 to be kept", values, name)
+		}
+	}
+	if _, ok := values[ipMetricPrefix+DefaultMetricName+labelsKey(withLabel(other, ipTag, "10.0.0.2"))]; !ok {
+		t.Errorf("got %v, expected the series of another target to be kept", values)
+	}
+	if len(r.infos) != 1 {
+		t.Errorf("got %v, expected the info of 10.0.0.2 to be forgotten", r.infos)
+	}
+
+	// the info series reported again after its deletion is the only one
+	ipReporter := newLabeledReporter(r, ipMetricPrefix, ipTag, "10.0.0.2", DefaultMetricName)
+	ipReporter.ReportInfo("version_info", labels, map[string]string{valueTag: "1.1"})
+	ipReporter.ReportInfo("version_info", labels, map[string]string{valueTag: "1.2"})
+	n := 0
+	for key := range collect(t, r) {
+		if strings.HasPrefix(key, ipMetricPrefix+"version_info") && strings.Contains(key, "10.0.0.2") {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("got %d version_info series for 10.0.0.2, expected 1", n)
+	}
+}
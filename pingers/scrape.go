@@ -0,0 +1,115 @@
+package pingers
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// scrapeMetrics parses the body as a Prometheus metrics page in text format, exports the series of the
+// metric exports and returns the checks of the metric assertions
+func scrapeMetrics(body []byte, httpRule *HTTPRule, reporter MetricReporter, labels map[string]string) []check {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(body))
+	if err != nil {
+		log.Printf("cannot parse metrics, %v", err)
+		return []check{{"metrics_format", false}}
+	}
+	familyList := make([]*dto.MetricFamily, 0, len(families))
+	for _, family := range families {
+		familyList = append(familyList, family)
+	}
+	samples, err := expfmt.ExtractSamples(&expfmt.DecodeOptions{Timestamp: model.Now()}, familyList...)
+	if err != nil {
+		log.Printf("cannot extract samples from metrics, %v", err)
+		return []check{{"metrics_format", false}}
+	}
+
+	checks := []check{{"metrics_format", true}}
+	for _, e := range httpRule.MetricExports {
+		checks = append(checks, check{"export:" + e.MetricName, e.export(samples, reporter, labels)})
+	}
+	for _, a := range httpRule.MetricAssertions {
+		selected := a.selectSamples(samples)
+		ok := len(selected) > 0
+		for _, sample := range selected {
+			if !a.match(float64(sample.Value)) {
+				log.Printf("metric assertion %s failed, %s is %v", a, sample.Metric, sample.Value)
+				ok = false
+			}
+		}
+		if len(selected) == 0 {
+			log.Printf("metric assertion %s failed, no series found", a)
+		}
+		checks = append(checks, check{"metric:" + a.String(), ok})
+	}
+	return checks
+}
+
+// selectSamples returns the samples having the name of the selector and matching its label matchers
+func (s *MetricSelector) selectSamples(samples model.Vector) model.Vector {
+	selected := model.Vector{}
+	for _, sample := range samples {
+		if string(sample.Metric[model.MetricNameLabel]) != s.Name {
+			continue
+		}
+		ok := true
+		for label, regex := range s.compiledMatchers {
+			if !regex.MatchString(string(sample.Metric[model.LabelName(label)])) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			selected = append(selected, sample)
+		}
+	}
+	return selected
+}
+
+// String returns the selector in the PromQL syntax, like up{job=~"api"}
+func (s *MetricSelector) String() string {
+	if len(s.Matchers) == 0 {
+		return s.Name
+	}
+	matchers := make([]string, 0, len(s.Matchers))
+	for label, regex := range s.Matchers {
+		matchers = append(matchers, fmt.Sprintf("%s=~%q", label, regex))
+	}
+	sort.Strings(matchers)
+	return s.Name + "{" + strings.Join(matchers, ",") + "}"
+}
+
+// export reports the selected series with the labels they keep, and deletes the series exported previously
+// which are not selected anymore. It exports nothing and returns false if two series have the same kept
+// labels, as only one of them could be reported.
+func (e *MetricExport) export(samples model.Vector, reporter MetricReporter, labels map[string]string) bool {
+	selected := e.selectSamples(samples)
+	exportLabels := make([]map[string]string, len(selected))
+	seen := map[string]bool{}
+	for i, sample := range selected {
+		exportLabels[i] = labels
+		for _, label := range e.KeepLabels {
+			exportLabels[i] = withLabel(exportLabels[i], label, string(sample.Metric[model.LabelName(label)]))
+		}
+		key := labelsKey(exportLabels[i])
+		if seen[key] {
+			log.Printf("metric export %s failed, several series have the labels %v, keep_labels must tell them apart",
+				e.MetricName, exportLabels[i])
+			reporter.DeleteStaleSeries(e.MetricName, labels, nil)
+			return false
+		}
+		seen[key] = true
+	}
+	for i, sample := range selected {
+		reporter.ReportValue(float64(sample.Value), e.MetricName, exportLabels[i])
+	}
+	reporter.DeleteStaleSeries(e.MetricName, labels, exportLabels)
+	return true
+}
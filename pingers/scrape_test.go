@@ -0,0 +1,79 @@
+package pingers
+
+import "testing"
+
+func TestMetricExports(t *testing.T) {
+	body := []byte(`# TYPE queue_size gauge
+queue_size{queue="orders",shard="1"} 3
+queue_size{queue="orders",shard="2"} 4
+queue_size{queue="payments",shard="1"} 5
+`)
+	labels := pingerLabels("http://a/metrics", "a", nil)
+	kept := func(queue, shard string) string {
+		exportLabels := labels
+		if queue != "" {
+			exportLabels = withLabel(exportLabels, "queue", queue)
+		}
+		if shard != "" {
+			exportLabels = withLabel(exportLabels, "shard", shard)
+		}
+		return "queue_size" + labelsKey(exportLabels)
+	}
+	selector := MetricSelector{Name: "queue_size"}
+	tests := []struct {
+		name   string
+		export *MetricExport
+		ok     bool
+		want   map[string]float64
+	}{
+		{"distinct series", &MetricExport{MetricSelector: selector, KeepLabels: []string{"queue", "shard"}}, true,
+			map[string]float64{kept("orders", "1"): 3, kept("orders", "2"): 4, kept("payments", "1"): 5}},
+		{"single series", &MetricExport{MetricSelector: MetricSelector{Name: "queue_size", Matchers: map[string]string{"queue": "payments"}}}, true,
+			map[string]float64{kept("", ""): 5}},
+		{"series without keep_labels", &MetricExport{MetricSelector: selector}, false, map[string]float64{}},
+		{"series with the same kept labels", &MetricExport{MetricSelector: selector, KeepLabels: []string{"queue"}}, false, map[string]float64{}},
+	}
+	for _, test := range tests {
+		if err := test.export.setup(); err != nil {
+			t.Fatal(err)
+		}
+		reporter := NewReporter("", nil)
+		checks := scrapeMetrics(body, &HTTPRule{MetricExports: []*MetricExport{test.export}}, reporter, labels)
+		if len(checks) != 2 || checks[1] != (check{"export:queue_size", test.ok}) {
+			t.Errorf("%s: got checks %v, expected export:queue_size to be %t", test.name, checks, test.ok)
+		}
+		got := collect(t, reporter)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.want)
+			continue
+		}
+		for key, value := range test.want {
+			if got[key] != value {
+				t.Errorf("%s: got %v, expected %v", test.name, got, test.want)
+			}
+		}
+	}
+}
+
+func TestMetricExportsDeleteStaleSeries(t *testing.T) {
+	export := &MetricExport{MetricSelector: MetricSelector{Name: "queue_size"}, KeepLabels: []string{"queue"}}
+	if err := export.setup(); err != nil {
+		t.Fatal(err)
+	}
+	httpRule := &HTTPRule{MetricExports: []*MetricExport{export}}
+	labels := pingerLabels("http://a/metrics", "a", nil)
+	reporter := NewReporter("", nil)
+	scrapeMetrics([]byte("queue_size{queue=\"orders\"} 3\nqueue_size{queue=\"payments\"} 5\n"), httpRule, reporter, labels)
+	scrapeMetrics([]byte("queue_size{queue=\"orders\"} 4\n"), httpRule, reporter, labels)
+	got := collect(t, reporter)
+	orders := "queue_size" + labelsKey(withLabel(labels, "queue", "orders"))
+	if len(got) != 1 || got[orders] != 4 {
+		t.Errorf("got %v, expected only %s at 4", got, orders)
+	}
+
+	// series of the same kept labels export nothing
+	scrapeMetrics([]byte("queue_size{queue=\"orders\",shard=\"1\"} 4\nqueue_size{queue=\"orders\",shard=\"2\"} 1\n"), httpRule, reporter, labels)
+	if got := collect(t, reporter); len(got) != 0 {
+		t.Errorf("got %v, expected no series", got)
+	}
+}
@@ -0,0 +1,148 @@
+package pingers
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// sseEvent is an event of a server-sent events stream
+type sseEvent struct {
+	eventType string
+	data      string
+}
+
+// pingerSSE connects to a server-sent events stream and waits for the number of events of the rule,
+// which must match the regexes of the rule
+func pingerSSE(urlStr string, reporter MetricReporter, r *Rule) error {
+	URL, err := url.Parse(urlStr)
+	if err != nil {
+		log.Printf("cannot parse url %s, %v\n", urlStr, err)
+		reporter.ReportSuccess(false, r.MetricName, pingerLabels(urlStr, "", r.tags))
+		return err
+	}
+	labels := urlLabels(URL, r.tags)
+	sseRule := r.SSERule
+	httpRule := r.HTTPRule
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(r.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		log.Printf("cannot create request for %s, %v\n", urlStr, err)
+		reporter.ReportSuccess(false, r.MetricName, labels)
+		return err
+	}
+	for name, val := range sseRule.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = val
+			continue
+		}
+		req.Header.Set(name, val)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	client := &http.Client{Transport: newHTTPTransport(r)}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if httpRule.ParsedProxyURL != nil {
+		reportChecks([]check{{"proxy", err == nil || !isProxyError(err)}}, urlStr, reporter, labels)
+	}
+	if err != nil {
+		log.Printf("Couldn't get %s: %v", urlStr, err)
+		reporter.ReportSuccess(false, r.MetricName, labels)
+		return err
+	}
+	defer resp.Body.Close()
+	reporter.ReportHttpStatus(resp.StatusCode, labels)
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	checks := []check{
+		{"status", validStatus(resp.StatusCode, httpRule)},
+		{"content_type", mediaType == "text/event-stream"},
+	}
+	checks = append(checks, matchHeaders(resp.Header, httpRule)...)
+
+	events := 0
+	typeOK := true
+	dataOK := true
+	if checks[0].ok && checks[1].ok {
+		reader := bufio.NewReader(io.LimitReader(resp.Body, httpRule.ReadMax))
+		for events < sseRule.Events {
+			event, err := readSSEEvent(reader)
+			if err != nil {
+				log.Printf("Couldn't read events of %s: %v", urlStr, err)
+				break
+			}
+			if events == 0 {
+				reporter.ReportValue(time.Since(start).Seconds(), "sse_first_event_seconds", labels)
+			}
+			events++
+			if sseRule.CompiledEventType != nil && !sseRule.CompiledEventType.MatchString(event.eventType) {
+				log.Printf("unexpected type %s of event of %s", event.eventType, urlStr)
+				typeOK = false
+			}
+			if sseRule.CompiledData != nil && !sseRule.CompiledData.MatchString(event.data) {
+				log.Printf("unexpected data %s of event of %s", event.data, urlStr)
+				dataOK = false
+			}
+		}
+	}
+	reporter.ReportValue(float64(events), "sse_events", labels)
+	checks = append(checks, check{"events", events == sseRule.Events})
+	if sseRule.CompiledEventType != nil {
+		checks = append(checks, check{"event_type", typeOK})
+	}
+	if sseRule.CompiledData != nil {
+		checks = append(checks, check{"event_data", dataOK})
+	}
+
+	ok := reportChecks(checks, urlStr, reporter, labels)
+	if ok {
+		reporter.ReportLatency(time.Since(start).Seconds(), labels)
+	}
+	reporter.ReportSuccess(ok, r.MetricName, labels)
+	return nil
+}
+
+// readSSEEvent returns the next event of the stream, the type of events without event field is message
+func readSSEEvent(reader *bufio.Reader) (*sseEvent, error) {
+	eventType := ""
+	data := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(data) == 0 {
+				// an event without data is not dispatched
+				eventType = ""
+				continue
+			}
+			if eventType == "" {
+				eventType = "message"
+			}
+			return &sseEvent{eventType: eventType, data: strings.Join(data, "\n")}, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
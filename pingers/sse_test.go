@@ -0,0 +1,108 @@
+package pingers
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestReadSSEEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []sseEvent
+	}{
+		{"single event", "data: hello\n\n", []sseEvent{{"message", "hello"}}},
+		{"multi-line data", "data: first\ndata: second\ndata\n\n", []sseEvent{{"message", "first\nsecond\n"}}},
+		{"comments", ": keep-alive\n\ndata: hello\n: ignored\n\n", []sseEvent{{"message", "hello"}}},
+		{"crlf", "event: update\r\ndata: hello\r\n\r\n", []sseEvent{{"update", "hello"}}},
+		{"event and id fields", "id: 1\nevent: update\ndata: a\n\nid: 2\ndata: b\n\n", []sseEvent{{"update", "a"}, {"message", "b"}}},
+		{"value without space", "event:update\ndata:hello\n\n", []sseEvent{{"update", "hello"}}},
+		{"event without data", "event: ping\n\ndata: hello\n\n", []sseEvent{{"message", "hello"}}},
+		{"missing trailing blank line", "data: a\n\ndata: b\n", []sseEvent{{"message", "a"}}},
+		{"unterminated line", "data: a\n\ndata: b", []sseEvent{{"message", "a"}}},
+	}
+	for _, test := range tests {
+		reader := bufio.NewReader(strings.NewReader(test.stream))
+		got := []sseEvent{}
+		var err error
+		for {
+			var event *sseEvent
+			if event, err = readSSEEvent(reader); err != nil {
+				break
+			}
+			got = append(got, *event)
+		}
+		if err != io.EOF {
+			t.Errorf("%s: got error %v, expected EOF", test.name, err)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %v, expected %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestPingerSSE(t *testing.T) {
+	stream := "event: update\ndata: {\"status\": \"ok\"}\n\n: keep-alive\n\nevent: update\ndata: {\"status\": \"ok\"}\n\n"
+	tests := []struct {
+		name        string
+		contentType string
+		stream      string
+		rule        *SSERule
+		want        map[string]bool // checks
+		events      float64
+	}{
+		{"matching events", "text/event-stream", stream, &SSERule{Events: 2, EventTypeRegex: "^update$", DataRegex: `"ok"`},
+			map[string]bool{"status": true, "content_type": true, "events": true, "event_type": true, "event_data": true}, 2},
+		{"unexpected type and data", "text/event-stream; charset=utf-8", stream, &SSERule{Events: 1, EventTypeRegex: "^message$", DataRegex: `"failed"`},
+			map[string]bool{"content_type": true, "events": true, "event_type": false, "event_data": false}, 1},
+		{"missing events", "text/event-stream", stream, &SSERule{Events: 3},
+			map[string]bool{"events": false}, 2},
+		{"not a stream", "text/plain", stream, &SSERule{},
+			map[string]bool{"content_type": false, "events": false}, 0},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Accept") != "text/event-stream" {
+				w.WriteHeader(http.StatusNotAcceptable)
+				return
+			}
+			w.Header().Set("Content-Type", test.contentType)
+			w.Write([]byte(test.stream))
+		}))
+		r := &Rule{Type: "sse", SSERule: test.rule}
+		if err := r.setup(); err != nil {
+			t.Fatal(err)
+		}
+		reporter := newFakeReporter()
+		pingerSSE(server.URL, reporter, r)
+		server.Close()
+		u, _ := url.Parse(server.URL)
+		labels := urlLabels(u, nil)
+		healthy := true
+		for name, ok := range test.want {
+			failed, found := reporter.values[checkFailedMetricName+labelsKey(withLabel(labels, checkTag, name))]
+			if !found || (failed == 0) != ok {
+				t.Errorf("%s: got %v, expected check %s to be %t", test.name, reporter.values, name, ok)
+			}
+			healthy = healthy && ok
+		}
+		if got := reporter.values["sse_events"+labelsKey(labels)]; got != test.events {
+			t.Errorf("%s: got %v events, expected %v", test.name, got, test.events)
+		}
+		if got := reporter.values[DefaultMetricName+labelsKey(labels)]; (got == 1) != healthy {
+			t.Errorf("%s: got health %v, expected %t", test.name, got, healthy)
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package pingers
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -10,8 +17,16 @@ import (
 func pingerTCP(addr string, reporter MetricReporter, c *Rule) error {
 	timeoutDuration := time.Second * time.Duration(c.Timeout)
 	start := time.Now()
-	conn, err := net.DialTimeout("tcp", addr, timeoutDuration)
-
+	conn, err := dialTCP(addr, c, timeoutDuration)
+	if c.expectsClosed() {
+		if err == nil {
+			conn.Close()
+		}
+		return reportPortState(portState(err), addr, reporter, c)
+	}
+	if c.TCPRule.ParsedProxyURL != nil {
+		reportChecks([]check{{"proxy", err == nil || !isProxyError(err)}}, addr, reporter, addrLabel(addr, c.tags))
+	}
 	if err != nil {
 		log.Printf("Couldn't connect to %s: %s", addr, err)
 		reporter.ReportSuccess(false, c.MetricName, addrLabel(addr, c.tags))
@@ -19,10 +34,110 @@ func pingerTCP(addr string, reporter MetricReporter, c *Rule) error {
 	}
 	defer conn.Close()
 	reporter.ReportLatency(time.Since(start).Seconds(), addrLabel(addr, c.tags))
-	reporter.ReportSuccess(true, c.MetricName, addrLabel(addr, c.tags))
+	reportIPProtocol(ipProtocol(conn.RemoteAddr()), reporter, addrLabel(addr, c.tags))
+	if !c.TCPRule.TLS && len(c.TCPRule.QueryResponse) == 0 {
+		reporter.ReportSuccess(true, c.MetricName, addrLabel(addr, c.tags))
+		return nil
+	}
+
+	conn.SetDeadline(start.Add(timeoutDuration))
+	ok := reportChecks(runTCPScript(conn, addr, c.TCPRule), addr, reporter, addrLabel(addr, c.tags))
+	reporter.ReportSuccess(ok, c.MetricName, addrLabel(addr, c.tags))
 	return nil
 }
 
+// runTCPScript runs the TLS handshake and the query_response script of the rule on the connection,
+// and returns one check per step. The steps following a failed step are failed.
+func runTCPScript(conn net.Conn, addr string, tcpRule *TCPRule) []check {
+	checks := []check{}
+	var err error
+	if tcpRule.TLS {
+		conn, err = startTLS(conn, addr, tcpRule)
+		if err != nil {
+			log.Printf("TLS handshake with %s failed, %v", addr, err)
+		}
+		checks = append(checks, check{"tls", err == nil})
+	}
+	reader := bufio.NewReader(conn)
+	vars := map[string]string{}
+	for i, step := range tcpRule.QueryResponse {
+		name := fmt.Sprintf("query_response:%d", i+1)
+		if err != nil {
+			checks = append(checks, check{name, false})
+			continue
+		}
+		switch {
+		case step.StartTLS:
+			var tlsConn net.Conn
+			tlsConn, err = startTLS(conn, addr, tcpRule)
+			if err == nil {
+				conn = tlsConn
+				reader = bufio.NewReader(conn)
+			}
+		default:
+			if step.CompiledExpect != nil {
+				err = expectLine(reader, step.CompiledExpect, vars)
+			}
+			if err == nil && step.Send != "" {
+				_, err = conn.Write([]byte(substituteVars(step.Send, vars) + "\r\n"))
+			}
+		}
+		if err != nil {
+			log.Printf("step %d of query_response failed for %s, %v", i+1, addr, err)
+		}
+		checks = append(checks, check{name, err == nil})
+	}
+	return checks
+}
+
+// expectLine reads lines until one matches the regex, its groups are stored in vars by name and by index
+func expectLine(reader *bufio.Reader, re *regexp.Regexp, vars map[string]string) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return fmt.Errorf("no line matching %s, %v", re, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		match := re.FindStringSubmatch(line)
+		if match == nil {
+			if err != nil {
+				return fmt.Errorf("no line matching %s, %v", re, err)
+			}
+			continue
+		}
+		for i, name := range re.SubexpNames() {
+			if i == 0 {
+				continue
+			}
+			vars[strconv.Itoa(i)] = match[i]
+			if name != "" {
+				vars[name] = match[i]
+			}
+		}
+		return nil
+	}
+}
+
+// startTLS runs a TLS handshake on the connection
+func startTLS(conn net.Conn, addr string, tcpRule *TCPRule) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: tcpRule.Insecure})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialTCP connects to addr, through the proxy of the rule if any
+func dialTCP(addr string, c *Rule, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if c.TCPRule.ParsedProxyURL == nil {
+		return c.dialContext(ctx, "tcp", addr)
+	}
+	return c.dialProxy(ctx, c.TCPRule.ParsedProxyURL, addr)
+}
+
 func addrLabel(addr string, others map[string]string) map[string]string {
 	hostPort := strings.SplitN(addr, ":", 1)
 	return pingerLabels(addr, hostPort[0], others)
@@ -0,0 +1,165 @@
+package pingers
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate returns the self-signed certificate of the httptest TLS servers
+func testCertificate() tls.Certificate {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+	return server.TLS.Certificates[0]
+}
+
+// smtpServer handles an SMTP session upgraded by STARTTLS, answering 500 to an unexpected command
+func smtpServer(cert tls.Certificate) func(net.Conn) {
+	return func(conn net.Conn) {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		expect := func(command string) bool {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return false
+			}
+			if strings.TrimRight(line, "\r\n") != command {
+				conn.Write([]byte("500 unexpected command\r\n"))
+				return false
+			}
+			return true
+		}
+		conn.Write([]byte("220 mail.example.com ESMTP\r\n"))
+		if !expect("EHLO prober") {
+			return
+		}
+		conn.Write([]byte("250-mail.example.com\r\n250 STARTTLS\r\n"))
+		if !expect("STARTTLS") {
+			return
+		}
+		conn.Write([]byte("220 ready to start TLS\r\n"))
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(conn)
+		if !expect("EHLO mail.example.com") {
+			return
+		}
+		conn.Write([]byte("250 mail.example.com\r\n"))
+		if !expect("QUIT") {
+			return
+		}
+		conn.Write([]byte("221 bye\r\n"))
+	}
+}
+
+func TestRunTCPScript(t *testing.T) {
+	cert := testCertificate()
+	smtp := []*QueryResponse{
+		{Expect: `^220 (?P<host>\S+)`, Send: "EHLO prober"},
+		{Expect: "^250 STARTTLS", Send: "STARTTLS"},
+		{Expect: "^220 "},
+		{StartTLS: true},
+		{Send: "EHLO ${host}"},
+		{Expect: "^250 ", Send: "QUIT"},
+		{Expect: "^221 "},
+	}
+	tests := []struct {
+		name   string
+		handle func(net.Conn)
+		rule   *TCPRule
+		want   []check
+	}{
+		{"starttls", smtpServer(cert), &TCPRule{Insecure: true, QueryResponse: smtp}, []check{
+			{"query_response:1", true}, {"query_response:2", true}, {"query_response:3", true},
+			{"query_response:4", true}, {"query_response:5", true}, {"query_response:6", true},
+			{"query_response:7", true},
+		}},
+		{"failed expect", func(conn net.Conn) {
+			conn.Write([]byte("554 no service\r\n"))
+		}, &TCPRule{QueryResponse: smtp[:3]}, []check{
+			{"query_response:1", false}, {"query_response:2", false}, {"query_response:3", false},
+		}},
+		{"unexpected command", smtpServer(cert), &TCPRule{QueryResponse: []*QueryResponse{
+			{Expect: "^220 ", Send: "HELO prober"},
+			{Expect: "^250 "},
+		}}, []check{
+			{"query_response:1", true}, {"query_response:2", false},
+		}},
+		{"tls", func(conn net.Conn) {
+			tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+			if tlsConn.Handshake() == nil {
+				tlsConn.Write([]byte("220 mail.example.com ESMTP\r\n"))
+			}
+		}, &TCPRule{TLS: true, Insecure: true, QueryResponse: smtp[:1]}, []check{
+			{"tls", true}, {"query_response:1", true},
+		}},
+		{"tls handshake failure", func(conn net.Conn) {
+			tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+		}, &TCPRule{TLS: true, QueryResponse: smtp[:2]}, []check{
+			{"tls", false}, {"query_response:1", false}, {"query_response:2", false},
+		}},
+	}
+	for _, test := range tests {
+		if err := test.rule.setup(); err != nil {
+			t.Fatal(err)
+		}
+		addr := serveProxy(t, test.handle)
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		got := runTCPScript(conn, addr, test.rule)
+		conn.Close()
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %v, expected %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestExpectLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		re    string
+		ok    bool
+		vars  map[string]string
+	}{
+		{"first line", "220 mail ESMTP\r\n", `^220 (\S+)`, true, map[string]string{"1": "mail"}},
+		{"skipped lines", "250-mail\r\n250-SIZE\r\n250 STARTTLS\r\n", `^250 (?P<ext>\S+)`, true, map[string]string{"1": "STARTTLS", "ext": "STARTTLS"}},
+		{"last line without newline", "220 mail", `^220 (\S+)$`, true, map[string]string{"1": "mail"}},
+		{"no matching line", "554 no service\r\n", `^220`, false, map[string]string{}},
+		{"empty input", "", `^220`, false, map[string]string{}},
+	}
+	for _, test := range tests {
+		re := regexp.MustCompile(test.re)
+		vars := map[string]string{}
+		err := expectLine(bufio.NewReader(strings.NewReader(test.input)), re, vars)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, expected success %t", test.name, err, test.ok)
+		}
+		if len(vars) != len(test.vars) {
+			t.Errorf("%s: got vars %v, expected %v", test.name, vars, test.vars)
+		}
+		for name, value := range test.vars {
+			if vars[name] != value {
+				t.Errorf("%s: got vars %v, expected %v", test.name, vars, test.vars)
+			}
+		}
+	}
+}
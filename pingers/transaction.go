@@ -0,0 +1,158 @@
+package pingers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const stepTag = "step"
+
+// stepMetricPrefix prefixes the name of the metrics reported for each step of a transaction
+const stepMetricPrefix = "step_"
+
+// pingerTransaction runs the steps of a transaction against the target URL. The metrics of each step are
+// prefixed by step_ and labeled with its name, the transaction succeeds if all of its steps do.
+func pingerTransaction(urlStr string, reporter MetricReporter, r *Rule) error {
+	URL, err := url.Parse(urlStr)
+	if err != nil {
+		log.Printf("cannot parse url %s, %v\n", urlStr, err)
+		reporter.ReportSuccess(false, r.MetricName, pingerLabels(urlStr, "", r.tags))
+		return err
+	}
+	labels := urlLabels(URL, r.tags)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	vars := map[string]string{}
+	ok := true
+	start := time.Now()
+	for _, step := range r.TransactionRule.Steps {
+		stepReporter := newLabeledReporter(reporter, stepMetricPrefix, stepTag, step.Name, r.MetricName)
+		if !ok {
+			// a step depends on the previous ones, it is failed if one of them failed
+			stepReporter.ReportSuccess(false, r.MetricName, labels)
+			continue
+		}
+		ok, err = runStep(step, URL, vars, jar, stepReporter, labels, r)
+		if err != nil {
+			log.Printf("transaction step %s failed for %s, %v\n", step.Name, urlStr, err)
+		}
+	}
+	if ok {
+		reporter.ReportLatency(time.Since(start).Seconds(), labels)
+	}
+	reporter.ReportSuccess(ok, r.MetricName, labels)
+	return err
+}
+
+// runStep sends the request of the step and checks its response, setting the variables it captures
+func runStep(step *TransactionStep, URL *url.URL, vars map[string]string, jar http.CookieJar,
+	reporter MetricReporter, labels map[string]string, r *Rule) (bool, error) {
+
+	stepURL, err := URL.Parse(substituteURLVars(step.URL, vars))
+	if err != nil {
+		reporter.ReportSuccess(false, r.MetricName, labels)
+		return false, err
+	}
+	var body io.Reader
+	if step.Body != "" {
+		body = strings.NewReader(substituteVars(step.Body, vars))
+	}
+	req, err := http.NewRequest(step.Method, stepURL.String(), body)
+	if err != nil {
+		reporter.ReportSuccess(false, r.MetricName, labels)
+		return false, err
+	}
+	for name, val := range step.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = substituteVars(val, vars)
+			continue
+		}
+		req.Header.Set(name, substituteVars(val, vars))
+	}
+
+	stepRule := *r
+	stepRule.HTTPRule = &step.HTTPRule
+	return probeHTTP(req, reporter, labels, &stepRule, jar, func(resp *http.Response, body []byte) []check {
+		checks := []check{}
+		for _, c := range step.Captures {
+			val, err := c.capture(resp, body)
+			if err != nil {
+				log.Printf("cannot capture %s, %v", c.Name, err)
+			} else {
+				vars[c.Name] = val
+			}
+			checks = append(checks, check{"capture:" + c.Name, err == nil})
+		}
+		return checks
+	})
+}
+
+// capture returns the value of the variable from the response
+func (c *Capture) capture(resp *http.Response, body []byte) (string, error) {
+	var text string
+	switch {
+	case c.compiledQuery != nil:
+		results, err := c.compiledQuery.run(body)
+		if err != nil {
+			return "", err
+		}
+		if len(results) == 0 || results[0] == nil {
+			return "", fmt.Errorf("query %s returned no value", c.JQQuery)
+		}
+		text = jsonString(results[0])
+	case c.Header != "":
+		if _, ok := resp.Header[http.CanonicalHeaderKey(c.Header)]; !ok {
+			return "", fmt.Errorf("missing header %s", c.Header)
+		}
+		text = resp.Header.Get(c.Header)
+	default:
+		text = string(body)
+	}
+	if c.CompiledRegex == nil {
+		return text, nil
+	}
+	match := c.CompiledRegex.FindStringSubmatch(text)
+	if match == nil {
+		return "", fmt.Errorf("no match for regex %s", c.Regex)
+	}
+	if len(match) > 1 {
+		return match[1], nil
+	}
+	return match[0], nil
+}
+
+// substituteURLVars replaces the uses of variables in rawURL by their value, escaped for the query
+// if they are after the ? and for the path otherwise, so that they cannot change the rest of the URL
+func substituteURLVars(rawURL string, vars map[string]string) string {
+	query := strings.Index(rawURL, "?")
+	uses := varRegex.FindAllStringSubmatchIndex(rawURL, -1)
+	var b strings.Builder
+	last := 0
+	for _, use := range uses {
+		b.WriteString(rawURL[last:use[0]])
+		val := vars[rawURL[use[2]:use[3]]]
+		if query >= 0 && use[0] > query {
+			b.WriteString(url.QueryEscape(val))
+		} else {
+			b.WriteString(url.PathEscape(val))
+		}
+		last = use[1]
+	}
+	b.WriteString(rawURL[last:])
+	return b.String()
+}
+
+// substituteVars replaces the uses of variables in text by their value
+func substituteVars(text string, vars map[string]string) string {
+	return varRegex.ReplaceAllStringFunc(text, func(use string) string {
+		return vars[varRegex.FindStringSubmatch(use)[1]]
+	})
+}
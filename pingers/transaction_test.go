@@ -0,0 +1,43 @@
+package pingers
+
+import "testing"
+
+func TestSubstituteVars(t *testing.T) {
+	vars := map[string]string{"token": "abc", "id": "42", "empty": ""}
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Bearer ${token}", "Bearer abc"},
+		{`{"id": ${id}, "token": "${token}"}`, `{"id": 42, "token": "abc"}`},
+		{"${token}${id}", "abc42"},
+		{"[${empty}]", "[]"},
+		{"[${missing}]", "[]"},
+		{"$token ${token ${1a} $${id}", "$token ${token  $42"},
+		{"no variable", "no variable"},
+	}
+	for _, test := range tests {
+		if got := substituteVars(test.text, vars); got != test.want {
+			t.Errorf("substituteVars(%s) = %s, expected %s", test.text, got, test.want)
+		}
+	}
+}
+
+func TestSubstituteURLVars(t *testing.T) {
+	vars := map[string]string{"id": "a/b?c", "token": "x&y=z #1", "plain": "abc"}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"/items/${plain}?q=${plain}", "/items/abc?q=abc"},
+		{"/items/${id}", "/items/a%2Fb%3Fc"},
+		{"/items?token=${token}&page=2", "/items?token=x%26y%3Dz+%231&page=2"},
+		{"/items/${id}?id=${id}", "/items/a%2Fb%3Fc?id=a%2Fb%3Fc"},
+		{"/items/${missing}", "/items/"},
+	}
+	for _, test := range tests {
+		if got := substituteURLVars(test.url, vars); got != test.want {
+			t.Errorf("substituteURLVars(%s) = %s, expected %s", test.url, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package pingers
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// pingerUDP sends the payload of the rule to addr, a host:port, and waits for a reply matching the
+// expected regex or hex pattern. The payload is sent again if no reply is received in time, the
+// timeout of the rule is shared between the attempts. The reported latency is the time since the
+// payload was first sent, as the reply can answer any of the attempts.
+func pingerUDP(addr string, reporter MetricReporter, c *Rule) error {
+	labels := addrLabel(addr, c.tags)
+	udpRule := c.UDPRule
+	timeoutDuration := time.Second * time.Duration(c.Timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutDuration)
+	defer cancel()
+	conn, err := c.dialContext(ctx, "udp", addr)
+	if err != nil && c.expectsClosed() {
+		return reportPortState(portState(err), addr, reporter, c)
+	}
+	if err != nil {
+		log.Printf("Couldn't connect to %s: %s", addr, err)
+		reporter.ReportSuccess(false, c.MetricName, labels)
+		return err
+	}
+	defer conn.Close()
+	reportIPProtocol(ipProtocol(conn.RemoteAddr()), reporter, labels)
+
+	attemptTimeout := timeoutDuration / time.Duration(udpRule.Retries+1)
+	buf := make([]byte, udpMaxDatagramSize)
+	var reply []byte
+	start := time.Now()
+	for attempt := 0; attempt <= udpRule.Retries && reply == nil; attempt++ {
+		conn.SetDeadline(time.Now().Add(attemptTimeout))
+		if _, err = conn.Write(udpRule.payload); err != nil {
+			break
+		}
+		var n int
+		n, err = conn.Read(buf)
+		if err == nil {
+			reply = buf[:n]
+		}
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			// a refused port, no need to retry
+			break
+		}
+	}
+	if c.expectsClosed() {
+		// a port not replying may also be open but ignore the payload
+		return reportPortState(portState(err), addr, reporter, c)
+	}
+	if reply == nil {
+		log.Printf("no reply from %s, %v", addr, err)
+		reporter.ReportValue(0, "udp_reply_received", labels)
+		reporter.ReportSuccess(false, c.MetricName, labels)
+		return err
+	}
+	reporter.ReportLatency(time.Since(start).Seconds(), labels)
+	reporter.ReportSize(len(reply), labels)
+	reporter.ReportValue(1, "udp_reply_received", labels)
+
+	checks := []check{}
+	if udpRule.CompiledExpect != nil {
+		checks = append(checks, check{"expect", udpRule.CompiledExpect.Match(reply)})
+	}
+	if udpRule.expectHex != nil {
+		checks = append(checks, check{"expect_hex", matchHexPattern(reply, udpRule.expectHex, udpRule.expectHexMask)})
+	}
+	ok := reportChecks(checks, addr, reporter, labels)
+	reporter.ReportSuccess(ok, c.MetricName, labels)
+	return nil
+}
+
+// udpMaxDatagramSize is the max size of a UDP reply
+const udpMaxDatagramSize = 65535
+
+// matchHexPattern returns true if reply starts with pattern, ignoring the bytes where mask is false
+func matchHexPattern(reply, pattern []byte, mask []bool) bool {
+	if len(reply) < len(pattern) {
+		return false
+	}
+	for i := range pattern {
+		if mask[i] && reply[i] != pattern[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHexPattern parses a hex string where ?? matches any byte, whitespace is ignored.
+// It returns the bytes of the pattern and whether each byte must match.
+func parseHexPattern(pattern string) ([]byte, []bool, error) {
+	pattern = strings.Join(strings.Fields(pattern), "")
+	if len(pattern)%2 != 0 {
+		return nil, nil, fmt.Errorf("hex pattern %s has an odd length", pattern)
+	}
+	values := make([]byte, len(pattern)/2)
+	mask := make([]bool, len(pattern)/2)
+	for i := range values {
+		digits := pattern[2*i : 2*i+2]
+		if digits == "??" {
+			continue
+		}
+		b, err := hex.DecodeString(digits)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid hex pattern %s, %v", pattern, err)
+		}
+		values[i] = b[0]
+		mask[i] = true
+	}
+	return values, mask, nil
+}
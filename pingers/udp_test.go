@@ -0,0 +1,111 @@
+package pingers
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// the latency of a reply to a retry is counted from the first attempt, as a late reply to the first one
+// could not be told apart
+func TestPingerUDPRetries(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, udpMaxDatagramSize)
+		for attempt := 0; ; attempt++ {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// the first payload is lost
+			if attempt > 0 {
+				conn.WriteTo(buf[:n], addr)
+			}
+		}
+	}()
+	r := &Rule{Type: "udp", Timeout: 1, UDPRule: &UDPRule{Send: "ping", ExpectRegex: "^ping$", Retries: 1}}
+	if err := r.setup(); err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	reporter := NewReporter("", nil)
+	if err := pingerUDP(addr, reporter, r); err != nil {
+		t.Fatal(err)
+	}
+	labels := addrLabel(addr, nil)
+	values := collect(t, reporter)
+	if values[DefaultMetricName+labelsKey(labels)] != 1 || values["udp_reply_received"+labelsKey(labels)] != 1 {
+		t.Errorf("got %v, expected a reply to the retry", values)
+	}
+	attemptTimeout := (time.Second / 2).Seconds()
+	if latency := values["latency_seconds"+labelsKey(labels)]; latency < attemptTimeout {
+		t.Errorf("got latency %v, expected at least the timeout of the first attempt %v", latency, attemptTimeout)
+	}
+
+	r.UDPRule.Retries = -1
+	if err := r.setup(); err == nil {
+		t.Errorf("negative retries accepted, expected an error")
+	}
+}
+
+func TestParseHexPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		values  []byte
+		mask    []bool
+		err     bool
+	}{
+		{"", []byte{}, []bool{}, false},
+		{"0a1B", []byte{0x0a, 0x1b}, []bool{true, true}, false},
+		{"00 ?? ff", []byte{0, 0, 0xff}, []bool{true, false, true}, false},
+		{"de ad\n\tbe ef", []byte{0xde, 0xad, 0xbe, 0xef}, []bool{true, true, true, true}, false},
+		{"abc", nil, nil, true},
+		{"a b c", nil, nil, true},
+		{"zz", nil, nil, true},
+		{"0?", nil, nil, true},
+	}
+	for _, test := range tests {
+		values, mask, err := parseHexPattern(test.pattern)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseHexPattern(%q) succeeded, expected an error", test.pattern)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(values, test.values) || !reflect.DeepEqual(mask, test.mask) {
+			t.Errorf("parseHexPattern(%q) = %x, %v, %v, expected %x, %v", test.pattern, values, mask, err, test.values, test.mask)
+		}
+	}
+}
+
+func TestMatchHexPattern(t *testing.T) {
+	pattern, mask, err := parseHexPattern("ab ?? cd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		reply []byte
+		match bool
+	}{
+		{[]byte{0xab, 0x00, 0xcd}, true},
+		{[]byte{0xab, 0xff, 0xcd, 0x01, 0x02}, true},
+		{[]byte{0xab, 0xff, 0xce}, false},
+		{[]byte{0xac, 0xff, 0xcd}, false},
+		{[]byte{0xab, 0xff}, false},
+		{[]byte{}, false},
+	}
+	for _, test := range tests {
+		if match := matchHexPattern(test.reply, pattern, mask); match != test.match {
+			t.Errorf("matchHexPattern(%x) = %t, expected %t", test.reply, match, test.match)
+		}
+	}
+	if !matchHexPattern([]byte{1}, []byte{}, []bool{}) {
+		t.Errorf("an empty pattern must match any reply")
+	}
+}
@@ -0,0 +1,246 @@
+package pingers
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// websocketGUID is concatenated to the handshake key to compute the accept header, see RFC 6455
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocket frame opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+var errWebSocketClosed = errors.New("websocket closed by the server")
+
+// pingerWebSocket opens a websocket with the ws or wss URL, sends the message of the rule if any
+// and waits for a message matching the expected regex if any
+func pingerWebSocket(urlStr string, reporter MetricReporter, r *Rule) error {
+	URL, err := url.Parse(urlStr)
+	if err != nil {
+		log.Printf("cannot parse url %s, %v\n", urlStr, err)
+		reporter.ReportSuccess(false, r.MetricName, pingerLabels(urlStr, "", r.tags))
+		return err
+	}
+	labels := urlLabels(URL, r.tags)
+	httpURL := *URL
+	switch URL.Scheme {
+	case "ws":
+		httpURL.Scheme = "http"
+	case "wss":
+		httpURL.Scheme = "https"
+	default:
+		err := fmt.Errorf("unsupported websocket scheme %s, expected ws or wss", URL.Scheme)
+		log.Printf("cannot probe %s, %v\n", urlStr, err)
+		reporter.ReportSuccess(false, r.MetricName, labels)
+		return err
+	}
+
+	wsRule := r.WebSocketRule
+	httpRule := r.HTTPRule
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(r.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpURL.String(), nil)
+	if err != nil {
+		log.Printf("cannot create request for %s, %v\n", urlStr, err)
+		reporter.ReportSuccess(false, r.MetricName, labels)
+		return err
+	}
+	for name, val := range wsRule.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = val
+			continue
+		}
+		req.Header.Set(name, val)
+	}
+	key := make([]byte, 16)
+	rand.Read(key)
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", encodedKey)
+
+	transport := newHTTPTransport(r)
+	// the upgrade requires HTTP/1.1
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	transport.ForceAttemptHTTP2 = false
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	if httpRule.ParsedProxyURL != nil {
+		reportChecks([]check{{"proxy", err == nil || !isProxyError(err)}}, urlStr, reporter, labels)
+	}
+	if err != nil {
+		log.Printf("Couldn't open websocket %s: %v", urlStr, err)
+		reporter.ReportSuccess(false, r.MetricName, labels)
+		return err
+	}
+	defer resp.Body.Close()
+	reporter.ReportValue(time.Since(start).Seconds(), "websocket_handshake_seconds", labels)
+	reporter.ReportHttpStatus(resp.StatusCode, labels)
+
+	conn, upgraded := resp.Body.(io.ReadWriteCloser)
+	upgraded = upgraded && resp.StatusCode == http.StatusSwitchingProtocols &&
+		resp.Header.Get("Sec-WebSocket-Accept") == websocketAccept(encodedKey)
+	checks := []check{{"handshake", upgraded}}
+	checks = append(checks, matchHeaders(resp.Header, httpRule)...)
+	if upgraded {
+		deadline, _ := ctx.Deadline()
+		timer := time.AfterFunc(time.Until(deadline), func() { conn.Close() })
+		defer timer.Stop()
+		exchangeStart := time.Now()
+		matched, err := wsRule.exchange(conn, httpRule.ReadMax)
+		if err != nil {
+			log.Printf("websocket exchange with %s failed, %v", urlStr, err)
+		}
+		if wsRule.CompiledExpect != nil {
+			checks = append(checks, check{"expect", matched})
+			if matched {
+				reporter.ReportValue(time.Since(exchangeStart).Seconds(), "websocket_round_trip_seconds", labels)
+			}
+		}
+		writeWebSocketFrame(conn, wsClose, []byte{0x03, 0xe8}) // normal closure
+	}
+
+	ok := reportChecks(checks, urlStr, reporter, labels)
+	if ok {
+		reporter.ReportLatency(time.Since(start).Seconds(), labels)
+	}
+	reporter.ReportSuccess(ok, r.MetricName, labels)
+	return nil
+}
+
+// websocketAccept returns the expected Sec-WebSocket-Accept header for the handshake key
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// exchange sends the message of the rule if any, then reads messages until one matches the expected regex.
+// It returns true if a message matched or if no message is expected.
+func (w *WebSocketRule) exchange(conn io.ReadWriter, readMax int64) (bool, error) {
+	if w.Send != "" {
+		if err := writeWebSocketFrame(conn, wsText, []byte(w.Send)); err != nil {
+			return false, err
+		}
+	}
+	if w.CompiledExpect == nil {
+		return true, nil
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := readWebSocketMessage(reader, conn, readMax)
+		if err != nil {
+			return false, err
+		}
+		if w.CompiledExpect.Match(msg) {
+			return true, nil
+		}
+	}
+}
+
+// writeWebSocketFrame writes a single masked frame, as required for frames sent by clients
+func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// readWebSocketMessage returns the next text or binary message, answering pings on the way
+func readWebSocketMessage(r *bufio.Reader, w io.Writer, readMax int64) ([]byte, error) {
+	var msg []byte
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		fin := header[0]&0x80 != 0
+		opcode := header[0] & 0x0f
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(r, ext); err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(r, ext); err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(ext)
+		}
+		var mask []byte
+		if header[1]&0x80 != 0 {
+			mask = make([]byte, 4)
+			if _, err := io.ReadFull(r, mask); err != nil {
+				return nil, err
+			}
+		}
+		if length > uint64(readMax)-uint64(len(msg)) {
+			return nil, fmt.Errorf("websocket message larger than read_max %d bytes", readMax)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		for i := range mask {
+			for j := i; j < len(payload); j += 4 {
+				payload[j] ^= mask[i]
+			}
+		}
+		switch opcode {
+		case wsClose:
+			return nil, errWebSocketClosed
+		case wsPing:
+			if err := writeWebSocketFrame(w, wsPong, payload); err != nil {
+				return nil, err
+			}
+		case wsPong:
+		case wsText, wsBinary, wsContinuation:
+			msg = append(msg, payload...)
+			if fin {
+				return msg, nil
+			}
+		default:
+			return nil, fmt.Errorf("unknown websocket opcode %d", opcode)
+		}
+	}
+}
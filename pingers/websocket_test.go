@@ -0,0 +1,231 @@
+package pingers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// readClientFrame reads a frame sent by a client, which must be masked, and returns its unmasked payload
+func readClientFrame(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if header[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("client frame is not masked")
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		io.ReadFull(r, ext)
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		io.ReadFull(r, ext)
+		length = binary.BigEndian.Uint64(ext)
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(r, mask); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0] & 0x0f, payload, nil
+}
+
+// serverFrame returns an unmasked frame, as sent by servers
+func serverFrame(fin bool, opcode byte, payload string) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	return append([]byte{first, byte(len(payload))}, payload...)
+}
+
+// websocketServer upgrades the connections, checks that the message of the client is hello and answers
+// with the frames returned by reply. The errors of the exchange are sent to errs.
+func websocketServer(t *testing.T, accept func(key string) string, reply func(r *bufio.Reader, w io.Writer) error,
+	errs chan<- error) *httptest.Server {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "websocket" || req.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n", accept(req.Header.Get("Sec-WebSocket-Key")))
+		rw.Flush()
+		opcode, payload, err := readClientFrame(rw.Reader)
+		if err == nil && (opcode != wsText || string(payload) != "hello") {
+			err = fmt.Errorf("got opcode %d and message %q, expected the text hello", opcode, payload)
+		}
+		if err == nil {
+			err = reply(rw.Reader, conn)
+		}
+		errs <- err
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	// example of RFC 6455
+	if accept := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("got %s, expected s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", accept)
+	}
+}
+
+func TestWriteWebSocketFrame(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		payload := bytes.Repeat([]byte("abc"), size/3+1)[:size]
+		var buf bytes.Buffer
+		if err := writeWebSocketFrame(&buf, wsBinary, payload); err != nil {
+			t.Fatal(err)
+		}
+		frame := buf.Bytes()
+		if frame[0] != 0x80|wsBinary {
+			t.Errorf("size %d: got first byte %x, expected fin and binary opcode", size, frame[0])
+		}
+		opcode, got, err := readClientFrame(bufio.NewReader(&buf))
+		if err != nil || opcode != wsBinary || !bytes.Equal(got, payload) {
+			t.Errorf("size %d: got opcode %d and %d bytes, %v, expected the payload", size, opcode, len(got), err)
+		}
+	}
+}
+
+func TestReadWebSocketMessage(t *testing.T) {
+	masked := []byte{0x80 | wsText, 0x80 | 2, 1, 2, 3, 4, 'h' ^ 1, 'i' ^ 2}
+	tests := []struct {
+		name    string
+		frames  [][]byte
+		readMax int64
+		want    string
+		err     bool
+	}{
+		{"text", [][]byte{serverFrame(true, wsText, "hello")}, 100, "hello", false},
+		{"fragments", [][]byte{serverFrame(false, wsText, "hel"), serverFrame(false, wsContinuation, "lo "),
+			serverFrame(true, wsContinuation, "world")}, 100, "hello world", false},
+		{"ping between fragments", [][]byte{serverFrame(false, wsText, "hel"), serverFrame(true, wsPing, "p"),
+			serverFrame(true, wsContinuation, "lo")}, 100, "hello", false},
+		{"pong", [][]byte{serverFrame(true, wsPong, ""), serverFrame(true, wsBinary, "x")}, 100, "x", false},
+		{"masked", [][]byte{masked}, 100, "hi", false},
+		{"close", [][]byte{serverFrame(true, wsClose, "\x03\xe8")}, 100, "", true},
+		{"larger than read_max", [][]byte{serverFrame(false, wsText, "hel"), serverFrame(true, wsContinuation, "lo")}, 4, "", true},
+		{"unknown opcode", [][]byte{serverFrame(true, 0x3, "")}, 100, "", true},
+		{"truncated", [][]byte{serverFrame(true, wsText, "hello")[:4]}, 100, "", true},
+	}
+	for _, test := range tests {
+		var pongs bytes.Buffer
+		msg, err := readWebSocketMessage(bufio.NewReader(bytes.NewReader(bytes.Join(test.frames, nil))), &pongs, test.readMax)
+		if (err != nil) != test.err || string(msg) != test.want {
+			t.Errorf("%s: got %q, %v, expected %q", test.name, msg, err, test.want)
+		}
+		if test.name == "ping between fragments" {
+			opcode, payload, err := readClientFrame(bufio.NewReader(&pongs))
+			if err != nil || opcode != wsPong || string(payload) != "p" {
+				t.Errorf("got opcode %d and %q, %v, expected a masked pong with the payload of the ping", opcode, payload, err)
+			}
+		}
+	}
+}
+
+func TestPingerWebSocket(t *testing.T) {
+	// pings the client, then sends hello world in two fragments
+	fragments := func(r *bufio.Reader, w io.Writer) error {
+		w.Write(serverFrame(true, wsPing, "p"))
+		opcode, payload, err := readClientFrame(r)
+		if err != nil || opcode != wsPong || string(payload) != "p" {
+			return fmt.Errorf("got opcode %d and %q, %v, expected a pong", opcode, payload, err)
+		}
+		w.Write(serverFrame(false, wsText, "hello "))
+		w.Write(serverFrame(true, wsContinuation, "world"))
+		opcode, payload, err = readClientFrame(r)
+		if err != nil || opcode != wsClose || !bytes.Equal(payload, []byte{0x03, 0xe8}) {
+			return fmt.Errorf("got opcode %d and %q, %v, expected a normal closure", opcode, payload, err)
+		}
+		return nil
+	}
+	closes := func(r *bufio.Reader, w io.Writer) error {
+		w.Write(serverFrame(true, wsClose, "\x03\xe8"))
+		return nil
+	}
+	wrongAccept := func(key string) string { return websocketAccept(key + "x") }
+	tests := []struct {
+		name      string
+		accept    func(key string) string
+		reply     func(r *bufio.Reader, w io.Writer) error
+		handshake bool
+		expect    bool
+	}{
+		{"exchange", websocketAccept, fragments, true, true},
+		{"closed by the server", websocketAccept, closes, true, false},
+		{"wrong accept", wrongAccept, nil, false, false},
+	}
+	for _, test := range tests {
+		errs := make(chan error, 1)
+		server := websocketServer(t, test.accept, test.reply, errs)
+		urlStr := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+		r := &Rule{Type: "websocket", WebSocketRule: &WebSocketRule{Send: "hello", ExpectRegex: "^hello world$"}}
+		if err := r.setup(); err != nil {
+			t.Fatal(err)
+		}
+		reporter := NewReporter("", nil)
+		pingerWebSocket(urlStr, reporter, r)
+		if test.handshake {
+			if err := <-errs; err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+		}
+
+		u, _ := url.Parse(urlStr)
+		labels := urlLabels(u, nil)
+		values := collect(t, reporter)
+		if failed := values[checkFailedMetricName+labelsKey(withLabel(labels, checkTag, "handshake"))]; (failed == 1) == test.handshake {
+			t.Errorf("%s: got handshake check failed %v, expected %t", test.name, failed, !test.handshake)
+		}
+		up := values[DefaultMetricName+labelsKey(labels)]
+		if test.handshake && (values[checkFailedMetricName+labelsKey(withLabel(labels, checkTag, "expect"))] == 0) != test.expect ||
+			(up == 1) != (test.handshake && test.expect) {
+			t.Errorf("%s: got %v, expected the expect check to be %t", test.name, values, test.expect)
+		}
+	}
+}
+
+func TestPingerWebSocketRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	urlStr := "ws" + strings.TrimPrefix(server.URL, "http")
+	r := &Rule{Type: "websocket"}
+	if err := r.setup(); err != nil {
+		t.Fatal(err)
+	}
+	reporter := NewReporter("", nil)
+	pingerWebSocket(urlStr, reporter, r)
+	u, _ := url.Parse(urlStr)
+	labels := urlLabels(u, nil)
+	values := collect(t, reporter)
+	if values[checkFailedMetricName+labelsKey(withLabel(labels, checkTag, "handshake"))] != 1 ||
+		values["response_code"+labelsKey(labels)] != 200 || values[DefaultMetricName+labelsKey(labels)] != 0 {
+		t.Errorf("got %v, expected a failed handshake for a 200 response", values)
+	}
+}